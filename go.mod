@@ -3,14 +3,17 @@ module github.com/apstndb/gcplistforeach
 go 1.16
 
 require (
-	cloud.google.com/go v0.81.0 // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/itchyny/gojq v0.12.3
 	github.com/jessevdk/go-flags v1.5.0
 	github.com/lestrrat-go/backoff/v2 v2.0.8
+	github.com/prometheus/client_golang v1.11.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	go.uber.org/ratelimit v0.2.0
-	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420 // indirect
-	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	google.golang.org/api v0.47.0
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
@@ -0,0 +1,68 @@
+package listforeach
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// circuitOpenError is the error of requests short-circuited by --circuit-breaker-threshold.
+type circuitOpenError struct {
+	host  string
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of %v is open until %v", e.host, e.until.Format(time.RFC3339))
+}
+
+// hostBreaker opens the circuit of a host after threshold consecutive failures, so requests to the host fail
+// immediately for cooldown instead of spending retries. After cooldown, requests are sent again and another failure
+// reopens the circuit.
+type hostBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newHostBreaker(threshold int, cooldown time.Duration) *hostBreaker {
+	return &hostBreaker{threshold: threshold, cooldown: cooldown, hosts: make(map[string]*breakerState)}
+}
+
+// allow returns circuitOpenError if the circuit of host is open at now.
+func (b *hostBreaker) allow(host string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.hosts[host]; ok && now.Before(s.openUntil) {
+		return &circuitOpenError{host: host, until: s.openUntil}
+	}
+	return nil
+}
+
+// observe records the result of a request to host, and reports whether it opened the circuit.
+func (b *hostBreaker) observe(host string, failed bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.hosts[host]
+	if !ok {
+		s = &breakerState{}
+		b.hosts[host] = s
+	}
+	if !failed {
+		s.failures = 0
+		return false
+	}
+	s.failures++
+	if s.failures < b.threshold || now.Before(s.openUntil) {
+		return false
+	}
+	s.openUntil = now.Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,87 @@
+package listforeach
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// etagCache keeps response bodies with their ETags keyed by URL, stored as a JSON object in a file.
+type etagCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	ETag string          `json:"etag"`
+	Body json.RawMessage `json:"body,omitempty"`
+	// RawBody is a body which isn't JSON, e.g. of --xml, encoded in base64.
+	RawBody []byte `json:"rawBody,omitempty"`
+}
+
+// body returns the cached body as received.
+func (e cacheEntry) body() []byte {
+	if e.RawBody != nil {
+		return e.RawBody
+	}
+	return e.Body
+}
+
+// loadETagCache reads the cache at path, which is empty if the file doesn't exist.
+func loadETagCache(path string) (*etagCache, error) {
+	c := &etagCache{path: path, entries: make(map[string]cacheEntry)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *etagCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *etagCache) put(key, etag string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if json.Valid(body) {
+		c.entries[key] = cacheEntry{ETag: etag, Body: body}
+	} else {
+		c.entries[key] = cacheEntry{ETag: etag, RawBody: body}
+	}
+}
+
+// save writes the cache into a temporary file and renames it so that the cache is never left broken.
+func (c *etagCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
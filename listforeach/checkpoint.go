@@ -0,0 +1,67 @@
+package listforeach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// checkpoint records keys of inputs completed successfully as lines of JSON values in a file.
+// Each record is appended and synced, so a crash loses at most the records being written,
+// and an incomplete last line is ignored on restart.
+type checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// openCheckpoint reads the keys recorded at path and opens it to append, creating it if it doesn't exist.
+func openCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	c := &checkpoint{done: make(map[string]bool)}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, len(b)+1)
+	for s.Scan() {
+		if line := bytes.TrimSpace(s.Bytes()); json.Valid(line) {
+			c.done[string(line)] = true
+		}
+	}
+
+	c.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// terminate the incomplete last line of a crash so that the next record isn't concatenated
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		if _, err := c.f.Write([]byte("\n")); err != nil {
+			c.f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *checkpoint) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[key]
+}
+
+func (c *checkpoint) record(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.WriteString(key + "\n"); err != nil {
+		return err
+	}
+	c.done[key] = true
+	return c.f.Sync()
+}
+
+func (c *checkpoint) close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,255 @@
+package listforeach
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+func staticTokenSource(accessToken string) oauth2.TokenSource {
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"})
+}
+
+// newTransport returns the base transport of requests including tokens.
+func newTransport(o Config, l *logger) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if o.InsecureSkipTLSVerify {
+		l.alwaysf(severityWarning, "WARNING: --insecure-skip-tls-verify disables TLS certificate verification, never use it in production")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if o.ClientCert != "" {
+		// presented in the TLS handshake under the bearer token of the oauth2 transport
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --client-cert and --client-key: %w", err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	if o.NoCompression {
+		transport.DisableCompression = true
+	}
+	// HTTP/2 multiplexes requests of workers over a connection, also with TLSClientConfig of --insecure-skip-tls-verify
+	transport.ForceAttemptHTTP2 = true
+	// reuse connections of all workers instead of 2 of http.DefaultMaxIdleConnsPerHost
+	idle := o.MaxIdleConns
+	if idle == 0 && o.Parallelism > http.DefaultMaxIdleConnsPerHost {
+		idle = int(o.Parallelism)
+	}
+	if idle > 0 {
+		transport.MaxIdleConnsPerHost = idle
+		if transport.MaxIdleConns < idle {
+			transport.MaxIdleConns = idle
+		}
+	}
+	transport.MaxConnsPerHost = o.MaxConnsPerHost
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy scheme must be http, https or socks5: %v", o.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return transport, nil
+}
+
+// refreshingTokenSource caches tokens of the source made by newSource, and remakes the source on invalidate.
+// Token sources of credentials reuse their tokens until the expiry, so remaking is the only way to force a refresh.
+type refreshingTokenSource struct {
+	newSource func() (oauth2.TokenSource, error)
+
+	mu     sync.Mutex
+	source oauth2.TokenSource
+}
+
+func newRefreshingTokenSource(newSource func() (oauth2.TokenSource, error)) (*refreshingTokenSource, error) {
+	source, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+	return &refreshingTokenSource{newSource: newSource, source: source}, nil
+}
+
+func (s *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source == nil {
+		source, err := s.newSource()
+		if err != nil {
+			return nil, err
+		}
+		s.source = source
+	}
+	return s.source.Token()
+}
+
+// invalidate drops the token rejected in authorization, unless the token is already refreshed by another request.
+func (s *refreshingTokenSource) invalidate(authorization string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source == nil {
+		return
+	}
+	if tok, err := s.source.Token(); err == nil && authorization != "" && tok.Type()+" "+tok.AccessToken != authorization {
+		return
+	}
+	s.source = nil
+}
+
+// newClient returns the client shared by all requests.
+// The returned token source is nil if the token can't be refreshed, i.e. --no-auth or --access-token.
+func newClient(ctx context.Context, o Config, l *logger) (*http.Client, *refreshingTokenSource, error) {
+	transport, err := newTransport(o, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.NoAuth {
+		return &http.Client{Transport: transport}, nil, nil
+	}
+	if o.AccessToken != "" && o.ImpersonateServiceAccount == "" {
+		return &http.Client{Transport: &oauth2.Transport{Source: staticTokenSource(o.AccessToken), Base: transport}}, nil, nil
+	}
+	ts, err := newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+		return newTokenSource(ctx, o, transport)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: transport}}, ts, nil
+}
+
+// newTokenSource returns the token source of credentials of o.
+func newTokenSource(ctx context.Context, o Config, transport http.RoundTripper) (oauth2.TokenSource, error) {
+	// oauth2 uses the client in ctx to fetch tokens
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+
+	scopes := o.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+
+	if o.ImpersonateServiceAccount != "" {
+		var clientOpts []option.ClientOption
+		if o.CredentialsFile != "" {
+			clientOpts = append(clientOpts, option.WithCredentialsFile(o.CredentialsFile))
+		}
+		if o.AccessToken != "" {
+			clientOpts = append(clientOpts, option.WithTokenSource(staticTokenSource(o.AccessToken)))
+		}
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: o.ImpersonateServiceAccount,
+			Scopes:          scopes,
+			Delegates:       o.ImpersonateDelegates,
+		}, clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %v with scopes %v: %w", o.ImpersonateServiceAccount, scopes, err)
+		}
+		return ts, nil
+	}
+	if o.CredentialsFile != "" {
+		b, err := os.ReadFile(o.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v with scopes %v: %w", o.CredentialsFile, scopes, err)
+		}
+		return creds.TokenSource, nil
+	}
+	creds, err := google.FindDefaultCredentials(ctx, o.Scopes...)
+	if err != nil && len(o.Scopes) > 0 {
+		return nil, fmt.Errorf("failed to find default credentials with scopes %v: %w", o.Scopes, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// responseTooLargeError is the error of a response body exceeding --max-response-size.
+type responseTooLargeError struct {
+	limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("response body exceeds --max-response-size of %d bytes", e.limit)
+}
+
+// readLimited reads all of r, but fails with responseTooLargeError after limit bytes if limit > 0.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, &responseTooLargeError{limit: limit}
+	}
+	return b, nil
+}
+
+// decodeContent decodes body of resp by Content-Encoding, and updates headers of resp for the decoded body.
+// The decoded body is also limited by limit, so a small compressed body can't expand beyond it.
+func decodeContent(resp *http.Response, body []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case "deflate":
+		// deflate is zlib format by RFC 9110, but some servers send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		} else {
+			r = zr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %v", encoding)
+	}
+	decoded, err := readLimited(r, limit)
+	var tooLarge *responseTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v body: %w", resp.Header.Get("Content-Encoding"), err)
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = int64(len(decoded))
+	resp.Uncompressed = true
+	return decoded, nil
+}
@@ -0,0 +1,295 @@
+package listforeach
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type encoder interface {
+	Encode(interface{}) error
+}
+
+type decoder interface {
+	Decode(interface{}) error
+}
+
+// ndjsonEncoder writes each value as a line of compact JSON by a single Write.
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+func (e *ndjsonEncoder) Encode(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+// adapter for bufio.Scanner
+type lineDecoder struct {
+	input *bufio.Scanner
+}
+
+type output struct {
+	Input      *interface{} `json:"input,omitempty" yaml:"input,omitempty"` // nil with --no-input
+	Index      int          `json:"index"`
+	URL        string       `json:"url"`
+	UrlIndex   *int         `json:"urlIndex,omitempty" yaml:"urlIndex,omitempty"` // only with multiple --url
+	Response   interface{}  `json:"response"`
+	Status     int          `json:"status,omitempty" yaml:"status,omitempty"`
+	StatusText string       `json:"statusText,omitempty" yaml:"statusText,omitempty"`
+	Error      string       `json:"error,omitempty" yaml:"error,omitempty"`
+	Truncated  bool         `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+	DurationMs *int64       `json:"durationMs,omitempty" yaml:"durationMs,omitempty"` // only with --timings
+	PageCount  *int         `json:"pageCount,omitempty" yaml:"pageCount,omitempty"`
+	Then       []thenOutput `json:"then,omitempty" yaml:"then,omitempty"` // only with --then-url
+}
+
+// thenOutput is a result of a follow-up request of --then-url.
+type thenOutput struct {
+	Item       int         `json:"item"`
+	URL        string      `json:"url"`
+	Response   interface{} `json:"response,omitempty" yaml:"response,omitempty"`
+	Status     int         `json:"status,omitempty" yaml:"status,omitempty"`
+	StatusText string      `json:"statusText,omitempty" yaml:"statusText,omitempty"`
+	Error      string      `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func newThenOutputs(results []ThenResult) []thenOutput {
+	var outputs []thenOutput
+	for _, res := range results {
+		o := thenOutput{Item: res.Item, URL: res.URL, Response: res.Response, Status: res.Status, StatusText: http.StatusText(res.Status)}
+		if res.Err != nil && res.Status == 0 {
+			o.Error = res.Err.Error()
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs
+}
+
+// requestOutput is a record of --dry-run-output.
+type requestOutput struct {
+	Input    *interface{} `json:"input,omitempty" yaml:"input,omitempty"`
+	Index    int          `json:"index"`
+	UrlIndex *int         `json:"urlIndex,omitempty" yaml:"urlIndex,omitempty"`
+	Method   string       `json:"method"`
+	URL      string       `json:"url"`
+	Headers  http.Header  `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Body     interface{}  `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+func newRequestOutput(input *interface{}, index int, urlIndex *int, req *http.Request) (requestOutput, error) {
+	record := requestOutput{Input: input, Index: index, UrlIndex: urlIndex, Method: req.Method, URL: req.URL.String(), Headers: req.Header}
+	if req.GetBody == nil {
+		return record, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return record, err
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&record.Body)
+	return record, err
+}
+
+// countOutput is a record of --count.
+type countOutput struct {
+	Input      *interface{} `json:"input,omitempty" yaml:"input,omitempty"`
+	Index      int          `json:"index"`
+	URL        string       `json:"url"`
+	UrlIndex   *int         `json:"urlIndex,omitempty" yaml:"urlIndex,omitempty"`
+	Count      int          `json:"count"`
+	Truncated  bool         `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+	DurationMs *int64       `json:"durationMs,omitempty" yaml:"durationMs,omitempty"`
+	PageCount  *int         `json:"pageCount,omitempty" yaml:"pageCount,omitempty"`
+}
+
+// timings returns durationMs and pageCount of res for --timings, or nils.
+func timings(res Result, enabled bool) (*int64, *int) {
+	if !enabled {
+		return nil, nil
+	}
+	durationMs, pageCount := res.Duration.Milliseconds(), res.Pages
+	return &durationMs, &pageCount
+}
+
+// rawResponse is the response of a body which isn't JSON.
+func rawResponse(resp *http.Response, body []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"rawBody":     string(body),
+		"contentType": resp.Header.Get("Content-Type"),
+	}
+}
+
+// itemOutput is a record of --flatten-with-input.
+type itemOutput struct {
+	Input    *interface{} `json:"input,omitempty" yaml:"input,omitempty"`
+	Index    int          `json:"index"`
+	URL      string       `json:"url"`
+	UrlIndex *int         `json:"urlIndex,omitempty" yaml:"urlIndex,omitempty"`
+	Item     interface{}  `json:"item"`
+}
+
+func (d *lineDecoder) Decode(i interface{}) error {
+	if !d.input.Scan() {
+		if d.input.Err() == nil {
+			return io.EOF
+		}
+		return d.input.Err()
+	}
+	reflect.Indirect(reflect.ValueOf(i)).Set(reflect.ValueOf(d.input.Text()))
+	return nil
+}
+
+// rawStringEncoder writes strings as is followed by a newline like jq -r for --raw-output, and others by enc.
+type rawStringEncoder struct {
+	w   io.Writer
+	enc encoder
+}
+
+func (e *rawStringEncoder) Encode(v interface{}) error {
+	if s, ok := v.(string); ok {
+		_, err := io.WriteString(e.w, s+"\n")
+		return err
+	}
+	return e.enc.Encode(v)
+}
+
+// yamlSeqEncoder buffers all values to write them as a single YAML sequence on Close for --yaml-seq-output.
+type yamlSeqEncoder struct {
+	enc    *yaml.Encoder
+	values []interface{}
+}
+
+func (e *yamlSeqEncoder) Encode(v interface{}) error {
+	e.values = append(e.values, v)
+	return nil
+}
+
+func (e *yamlSeqEncoder) Close() error {
+	if e.values == nil {
+		e.values = []interface{}{}
+	}
+	if err := e.enc.Encode(e.values); err != nil {
+		return err
+	}
+	return e.enc.Close()
+}
+
+// jsonArrayDecoder decodes each element of top-level JSON arrays for --json-array-input.
+type jsonArrayDecoder struct {
+	dec     *json.Decoder
+	inArray bool
+}
+
+func (d *jsonArrayDecoder) Decode(i interface{}) error {
+	for !d.inArray || !d.dec.More() {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch {
+		case tok == json.Delim('[') && !d.inArray:
+			d.inArray = true
+		case tok == json.Delim(']') && d.inArray:
+			d.inArray = false
+		default:
+			return fmt.Errorf("input must be JSON arrays with --json-array-input: %v", tok)
+		}
+	}
+	return d.dec.Decode(i)
+}
+
+// batchDecoder decodes up to size values of dec at once into an array for --batch-size.
+type batchDecoder struct {
+	dec  decoder
+	size int
+}
+
+func (d *batchDecoder) Decode(i interface{}) error {
+	var batch []interface{}
+	for len(batch) < d.size {
+		var v interface{}
+		if err := d.dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		batch = append(batch, v)
+	}
+	if len(batch) == 0 {
+		return io.EOF
+	}
+	reflect.Indirect(reflect.ValueOf(i)).Set(reflect.ValueOf(batch))
+	return nil
+}
+
+// adapter for csv.Reader and tsvReader, which decodes each row into an object keyed by the header row
+type csvDecoder struct {
+	r interface {
+		Read() ([]string, error)
+	}
+	header []string
+}
+
+func (d *csvDecoder) Decode(i interface{}) error {
+	if d.header == nil {
+		header, err := d.r.Read()
+		if err != nil {
+			return err
+		}
+		d.header = header
+	}
+	record, err := d.r.Read()
+	if err != nil {
+		return err
+	}
+	if len(record) != len(d.header) {
+		return fmt.Errorf("wrong number of fields, expected %v: %q", len(d.header), record)
+	}
+	m := make(map[string]interface{}, len(d.header))
+	for i, name := range d.header {
+		m[name] = record[i]
+	}
+	reflect.Indirect(reflect.ValueOf(i)).Set(reflect.ValueOf(m))
+	return nil
+}
+
+// tsvReader reads tab-separated rows without quoting.
+type tsvReader struct {
+	input *bufio.Scanner
+}
+
+func (r *tsvReader) Read() ([]string, error) {
+	if !r.input.Scan() {
+		if r.input.Err() == nil {
+			return nil, io.EOF
+		}
+		return nil, r.input.Err()
+	}
+	return strings.Split(r.input.Text(), "\t"), nil
+}
+
+// syncFile commits the written data of w to the storage if w is a regular file, for --flush-interval.
+// Other writers like pipes and terminals are not buffered.
+func syncFile(w io.Writer) error {
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	return f.Sync()
+}
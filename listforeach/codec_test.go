@@ -0,0 +1,62 @@
+package listforeach
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRecorder keeps each Write separately.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestNdjsonEncoder(t *testing.T) {
+	records := []interface{}{
+		map[string]interface{}{"input": "a", "response": map[string]interface{}{"items": []interface{}{1.0, map[string]interface{}{"name": "x"}}}},
+		map[string]interface{}{"text": "line1\nline2", "html": "<b>&</b>"},
+		"plain",
+	}
+	want := []string{
+		`{"input":"a","response":{"items":[1,{"name":"x"}]}}` + "\n",
+		// escaped like the default encoder
+		`{"html":"\u003cb\u003e\u0026\u003c/b\u003e","text":"line1\nline2"}` + "\n",
+		`"plain"` + "\n",
+	}
+
+	var w writeRecorder
+	enc := &ndjsonEncoder{&w}
+	for _, v := range records {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(w.writes, want) {
+		t.Fatalf("writes = %q, want %q", w.writes, want)
+	}
+
+	out := strings.Join(w.writes, "")
+	if n := strings.Count(out, "\n"); n != len(records) {
+		t.Errorf("output has %v lines, want %v", n, len(records))
+	}
+	dec := json.NewDecoder(bytes.NewBufferString(out))
+	for i, v := range records {
+		var got interface{}
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("record %v: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("record %v = %v, want %v", i, got, v)
+		}
+	}
+	if dec.More() {
+		t.Error("trailing data after records")
+	}
+}
@@ -0,0 +1,92 @@
+package listforeach
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// deduper coalesces identical requests in flight, and keeps their responses for the run if keep is true.
+type deduper struct {
+	keep  bool
+	group singleflight.Group
+
+	mu        sync.Mutex
+	responses map[string]*dedupedResponse
+}
+
+// dedupedResponse is a response read into memory to be shared by callers.
+type dedupedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+func (r *dedupedResponse) response() *http.Response {
+	resp := *r.resp
+	resp.Body = io.NopCloser(bytes.NewReader(r.body))
+	return &resp
+}
+
+func newDeduper(keep bool) *deduper {
+	return &deduper{keep: keep, responses: make(map[string]*dedupedResponse)}
+}
+
+// dedupeKey identifies req by the method, the URL, the headers and the body.
+func dedupeKey(req *http.Request) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(req.Method + " " + req.URL.String() + "\n")
+	if err := req.Header.Write(&buf); err != nil {
+		return "", err
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(&buf, body); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// do calls fn for req unless an identical request is in flight or kept, and returns a copy of the response.
+func (d *deduper) do(req *http.Request, fn func() (*http.Response, error)) (*http.Response, error) {
+	key, err := dedupeKey(req)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	kept, ok := d.responses[key]
+	d.mu.Unlock()
+	if ok {
+		return kept.response(), nil
+	}
+
+	v, err, _ := d.group.Do(key, func() (interface{}, error) {
+		resp, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		deduped := &dedupedResponse{resp: resp, body: body}
+		if d.keep {
+			d.mu.Lock()
+			d.responses[key] = deduped
+			d.mu.Unlock()
+		}
+		return deduped, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*dedupedResponse).response(), nil
+}
@@ -0,0 +1,342 @@
+package listforeach
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var fieldPathPattern = regexp.MustCompile(`^\.?[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// fieldExpr locates a field in a response by a dotted path like items.instances or a jq filter.
+type fieldExpr struct {
+	src  string
+	path []string // nil if src is a jq filter
+	code *query
+}
+
+func compileFieldExpr(src string, env jqEnv) (*fieldExpr, error) {
+	if fieldPathPattern.MatchString(src) {
+		return &fieldExpr{src: src, path: strings.Split(strings.TrimPrefix(src, "."), ".")}, nil
+	}
+	code, err := compileQuery(src, env)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldExpr{src: src, code: code}, nil
+}
+
+// values returns all values of the field in v.
+func (e *fieldExpr) values(v interface{}) ([]interface{}, error) {
+	if e.code == nil {
+		for _, k := range e.path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			if v, ok = m[k]; !ok {
+				return nil, nil
+			}
+		}
+		return []interface{}{v}, nil
+	}
+	return runAll(e.code, v)
+}
+
+// items returns all elements of the arrays found by the expression in v.
+func (e *fieldExpr) items(v interface{}) ([]interface{}, error) {
+	vs, err := e.values(v)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	for _, v := range vs {
+		if c, ok := v.([]interface{}); ok {
+			items = append(items, c...)
+		}
+	}
+	return items, nil
+}
+
+// string returns the first string value of the field in v, or empty if there is none.
+func (e *fieldExpr) string(v interface{}) (string, error) {
+	vs, err := e.values(v)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return "", nil
+}
+
+// int returns the first number, or string of an integer like int64 fields of Google APIs, in v.
+// ok is false if not found.
+func (e *fieldExpr) int(v interface{}) (n int, ok bool, err error) {
+	vs, err := e.values(v)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, v := range vs {
+		switch v := v.(type) {
+		case int:
+			return v, true, nil
+		case float64:
+			return int(v), true, nil
+		case string:
+			if n, err := strconv.Atoi(v); err == nil {
+				return n, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// set stores v into m at the dotted path, or at the key named by the jq filter itself.
+func (e *fieldExpr) set(m map[string]interface{}, v interface{}) {
+	if e.code != nil {
+		m[e.src] = v
+		return
+	}
+	for _, k := range e.path[:len(e.path)-1] {
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[k] = child
+		}
+		m = child
+	}
+	m[e.path[len(e.path)-1]] = v
+}
+
+// aggregatedItems collects items found by e in each scope of the items map of aggregatedList responses.
+// If scopeField is not empty, object items are copied with the scope key stored into scopeField.
+func aggregatedItems(page map[string]interface{}, e *fieldExpr, scopeField string) ([]interface{}, error) {
+	scopes, _ := page["items"].(map[string]interface{})
+	keys := make([]string, 0, len(scopes))
+	for k := range scopes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var items []interface{}
+	for _, scope := range keys {
+		scopeItems, err := e.items(scopes[scope])
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range scopeItems {
+			if m, ok := item.(map[string]interface{}); ok && scopeField != "" {
+				copied := make(map[string]interface{}, len(m)+1)
+				for k, v := range m {
+					copied[k] = v
+				}
+				copied[scopeField] = scope
+				item = copied
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// inferCollection finds the collection of --auto-collection in the first page, which is the key named after the URL
+// if it is an array, or else the only array-valued key. fallback named after the URL is kept if page has no arrays,
+// e.g. an empty page omitting the collection.
+func inferCollection(page map[string]interface{}, fallback *fieldExpr) (*fieldExpr, error) {
+	if _, ok := page[fallback.src].([]interface{}); ok {
+		return fallback, nil
+	}
+	var keys []string
+	for k, v := range page {
+		if _, ok := v.([]interface{}); ok {
+			keys = append(keys, k)
+		}
+	}
+	switch len(keys) {
+	case 0:
+		return fallback, nil
+	case 1:
+		return &fieldExpr{src: keys[0], path: []string{keys[0]}}, nil
+	default:
+		sort.Strings(keys)
+		return nil, fmt.Errorf("can't infer the collection from arrays %v, use --collection", strings.Join(keys, ", "))
+	}
+}
+
+// inferDeepCollection finds the collection of --deep-collection, which may be nested in objects of page.
+// Searching objects breadth-first, the only array of the first object having tokenKey wins, e.g. result.data.items of
+// {result: {data: {items: [...], nextPageToken: "..."}}}, and the path of the token in the object is also returned
+// to page by. Without such objects, e.g. on the last page, the first object with inferCollection rules is used
+// with a nil path. fallback is kept if page has no arrays at all.
+func inferDeepCollection(page map[string]interface{}, fallback *fieldExpr, tokenKey string) (*fieldExpr, []string, error) {
+	type node struct {
+		path []string
+		obj  map[string]interface{}
+	}
+	arrays := func(n node) []string {
+		var keys []string
+		for k, v := range n.obj {
+			if _, ok := v.([]interface{}); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	var nodes []node
+	for queue := []node{{obj: page}}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		nodes = append(nodes, n)
+		var keys []string
+		for k := range n.obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if m, ok := n.obj[k].(map[string]interface{}); ok {
+				queue = append(queue, node{path: append(n.path[:len(n.path):len(n.path)], k), obj: m})
+			}
+		}
+	}
+	expr := func(n node, key string) *fieldExpr {
+		path := append(n.path[:len(n.path):len(n.path)], key)
+		return &fieldExpr{src: strings.Join(path, "."), path: path}
+	}
+	for _, n := range nodes {
+		if _, ok := n.obj[tokenKey]; !ok {
+			continue
+		}
+		switch keys := arrays(n); len(keys) {
+		case 0:
+		case 1:
+			return expr(n, keys[0]), expr(n, tokenKey).path, nil
+		default:
+			return nil, nil, fmt.Errorf("can't infer the collection from arrays %v next to %v, use --collection", strings.Join(keys, ", "), tokenKey)
+		}
+	}
+	for _, n := range nodes {
+		if _, ok := n.obj[fallback.src].([]interface{}); ok {
+			return expr(n, fallback.src), nil, nil
+		}
+		switch keys := arrays(n); len(keys) {
+		case 0:
+		case 1:
+			return expr(n, keys[0]), nil, nil
+		default:
+			return nil, nil, fmt.Errorf("can't infer the collection from arrays %v, use --collection", strings.Join(keys, ", "))
+		}
+	}
+	return fallback, nil, nil
+}
+
+// dedupeItems returns items whose first result of code is not in seen, and adds the results into seen.
+// Results are compared by their JSON encoding.
+func dedupeItems(code *query, items []interface{}, seen map[string]bool) ([]interface{}, error) {
+	var deduped []interface{}
+	for _, item := range items {
+		v, err := runFirst(code, item)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if seen[string(b)] {
+			continue
+		}
+		seen[string(b)] = true
+		deduped = append(deduped, item)
+	}
+	return deduped, nil
+}
+
+// selectItems returns items for which the first result of code is neither false nor null.
+func selectItems(code *query, items []interface{}) ([]interface{}, error) {
+	var selected []interface{}
+	for _, item := range items {
+		v, err := runFirst(code, item)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil && v != false {
+			selected = append(selected, item)
+		}
+	}
+	return selected, nil
+}
+
+// mapItems returns all results of code for each item.
+func mapItems(code *query, items []interface{}) ([]interface{}, error) {
+	var mapped []interface{}
+	for _, item := range items {
+		vs, err := runAll(code, item)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, vs...)
+	}
+	return mapped, nil
+}
+
+// collectionResponse builds a response which has only the collection.
+func collectionResponse(e *fieldExpr, collection []interface{}) map[string]interface{} {
+	response := make(map[string]interface{})
+	// leave response empty if collection is nil
+	if collection != nil {
+		e.set(response, collection)
+	}
+	return response
+}
+
+// auxiliaryKeys are fields of partial results and warnings kept alongside the collection even without --merge-fields,
+// like unreachable of AIP-217 and warning of Compute Engine.
+var auxiliaryKeys = map[string]bool{"unreachable": true, "unreachables": true, "warning": true, "warnings": true}
+
+// mergeFields merges fields of page for which keep returns true into merged, and returns merged.
+// The first value of each field is kept, except that arrays are concatenated across pages.
+func mergeFields(merged, page map[string]interface{}, keep func(key string) bool) map[string]interface{} {
+	for k, v := range page {
+		if !keep(k) {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]interface{})
+		}
+		prev, ok := merged[k]
+		if !ok {
+			merged[k] = v
+			continue
+		}
+		a, aok := prev.([]interface{})
+		b, bok := v.([]interface{})
+		if aok && bok {
+			merged[k] = append(a[:len(a):len(a)], b...)
+		}
+	}
+	return merged
+}
+
+// withFields sets fields into response unless response has the keys.
+func withFields(response, fields map[string]interface{}) map[string]interface{} {
+	for k, v := range fields {
+		if _, ok := response[k]; !ok {
+			response[k] = v
+		}
+	}
+	return response
+}
+
+// topKey is the top-level key of the field in responses.
+func (e *fieldExpr) topKey() string {
+	if e.path == nil {
+		return e.src
+	}
+	return e.path[0]
+}
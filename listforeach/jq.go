@@ -0,0 +1,257 @@
+package listforeach
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// locationPattern matches regions like us-central1, zones like us-central1-a, and multi-regions like us or global.
+var locationPattern = regexp.MustCompile(`^[a-z]+(-[a-z]+)*[0-9]*(-[a-z])?$`)
+
+// jqEnv is the environment of all jq filters.
+// Variables are $project of --project, $location of --location and others of --arg and --argjson,
+// and functions are regional_host and ones defined in --jq-library.
+type jqEnv struct {
+	names    []string
+	values   []interface{}
+	location string
+	library  *libraryLoader // nil without --jq-library
+	// bindInput binds the last name to the input of each run
+	bindInput bool
+}
+
+// newJQEnv parses name=value of args and name=json of argJSON, and loads jq files of libraries.
+func newJQEnv(project, location string, args, argJSON, libraries []string) (jqEnv, error) {
+	env := jqEnv{names: []string{"$project", "$location"}, values: []interface{}{nil, nil}, location: location}
+	if project != "" {
+		env.values[0] = project
+	}
+	if location != "" {
+		env.values[1] = location
+	}
+	add := func(flag, s string, parse func(string) (interface{}, error)) error {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid %v, must be name=value: %v", flag, s)
+		}
+		name := s[:i]
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name of %v: %v", flag, name)
+		}
+		for _, n := range env.names {
+			if n == "$"+name {
+				return fmt.Errorf("duplicate variable of %v: %v", flag, name)
+			}
+		}
+		v, err := parse(s[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid JSON of %v %v: %w", flag, name, err)
+		}
+		env.names = append(env.names, "$"+name)
+		env.values = append(env.values, v)
+		return nil
+	}
+	for _, s := range args {
+		if err := add("--arg", s, func(s string) (interface{}, error) { return s, nil }); err != nil {
+			return jqEnv{}, err
+		}
+	}
+	for _, s := range argJSON {
+		err := add("--argjson", s, func(s string) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal([]byte(s), &v)
+			return v, err
+		})
+		if err != nil {
+			return jqEnv{}, err
+		}
+	}
+	if len(libraries) > 0 {
+		var err error
+		env.library, err = loadLibraries(libraries)
+		if err != nil {
+			return jqEnv{}, err
+		}
+	}
+	return env, nil
+}
+
+// libraryLoader is a gojq.ModuleLoader which provides jq files of --jq-library as init modules,
+// so their functions are available in all jq filters without import.
+type libraryLoader struct {
+	queries []*gojq.Query
+}
+
+// loadLibraries parses all files in advance to report errors with the path.
+func loadLibraries(paths []string) (*libraryLoader, error) {
+	l := &libraryLoader{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		q, err := gojq.Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v: %w", path, err)
+		}
+		l.queries = append(l.queries, q)
+	}
+	return l, nil
+}
+
+func (l *libraryLoader) LoadInitModules() ([]*gojq.Query, error) {
+	return l.queries, nil
+}
+
+// regionalHost is regional_host($service) and regional_host($service; $location), which returns the regional host of service like us-central1-aiplatform.googleapis.com.
+// service may be a host like aiplatform.googleapis.com, and location defaults to --location.
+func (env jqEnv) regionalHost(_ interface{}, args []interface{}) interface{} {
+	service, ok := args[0].(string)
+	if !ok || service == "" {
+		return fmt.Errorf("regional_host: service must be a non-empty string: %v", args[0])
+	}
+	location := env.location
+	if len(args) > 1 {
+		s, ok := args[1].(string)
+		if !ok {
+			return fmt.Errorf("regional_host: location must be a string: %v", args[1])
+		}
+		location = s
+	}
+	if location == "" {
+		return errors.New("regional_host: location must be given by --location or the second argument")
+	}
+	if !locationPattern.MatchString(location) {
+		return fmt.Errorf("regional_host: invalid location: %v", location)
+	}
+	return location + "-" + strings.TrimSuffix(service, ".googleapis.com") + ".googleapis.com"
+}
+
+// withInputVariable returns env which also binds name, e.g. $batch of --batch-size, to the input of each run.
+func (env jqEnv) withInputVariable(name string) jqEnv {
+	env.names = append(env.names[:len(env.names):len(env.names)], name)
+	env.bindInput = true
+	return env
+}
+
+// query is a compiled jq filter run with the values of variables.
+type query struct {
+	code      *gojq.Code
+	values    []interface{}
+	bindInput bool
+}
+
+func (q *query) Run(v interface{}) gojq.Iter {
+	if q.bindInput {
+		return q.code.Run(v, append(q.values[:len(q.values):len(q.values)], v)...)
+	}
+	return q.code.Run(v, q.values...)
+}
+
+func compileQuery(src string, env jqEnv) (*query, error) {
+	parsed, err := gojq.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	opts := []gojq.CompilerOption{gojq.WithVariables(env.names), gojq.WithFunction("regional_host", 1, 2, env.regionalHost)}
+	if env.library != nil {
+		opts = append(opts, gojq.WithModuleLoader(env.library))
+	}
+	code, err := gojq.Compile(parsed, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &query{code: code, values: env.values, bindInput: env.bindInput}, nil
+}
+
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} in src by the environment variable for --expand-env.
+// Unbraced $name is left for jq variables, and unset variables are errors rather than empty strings.
+func expandEnv(src string) (string, error) {
+	var err error
+	expanded := envRefPattern.ReplaceAllStringFunc(src, func(ref string) string {
+		name := envRefPattern.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable is not set: %v", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// runFirst returns the first result of code, or nil if code yields nothing.
+func runFirst(code *query, input interface{}) (interface{}, error) {
+	v, ok := code.Run(input).Next()
+	if !ok {
+		return nil, nil
+	}
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	return v, nil
+}
+
+// toJSONValue converts v to a value consists of JSON types which can be passed to gojq.
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var jv interface{}
+	err = json.Unmarshal(b, &jv)
+	return jv, err
+}
+
+// runAll returns all results of code.
+func runAll(code *query, input interface{}) ([]interface{}, error) {
+	var vs []interface{}
+	iter := code.Run(input)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return vs, nil
+		}
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+}
+
+// chainIter yields results of codes run against the same input in order.
+type chainIter struct {
+	codes []*query
+	input interface{}
+	// index is the index of the code of the last result
+	index int
+	iter  gojq.Iter
+}
+
+func runChain(codes []*query, input interface{}) *chainIter {
+	return &chainIter{codes: codes, input: input, index: -1}
+}
+
+func (it *chainIter) Next() (interface{}, bool) {
+	for {
+		if it.iter != nil {
+			if v, ok := it.iter.Next(); ok {
+				return v, true
+			}
+		}
+		if it.index+1 >= len(it.codes) {
+			return nil, false
+		}
+		it.index++
+		it.iter = it.codes[it.index].Run(it.input)
+	}
+}
@@ -0,0 +1,2127 @@
+// Package listforeach calls Google Cloud APIs for each input and collects paginated responses.
+package listforeach
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lestrrat-go/backoff/v2"
+	"go.uber.org/ratelimit"
+	"gopkg.in/yaml.v3"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// Caution: nextPageToken should be included in filter
+
+// tracer returns the tracer of the global provider, so spans are exported only if the caller installs one.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/apstndb/gcplistforeach/listforeach")
+}
+
+const (
+	paginationPageToken  = "page-token"
+	paginationLinkHeader = "link-header"
+	paginationOffset     = "offset"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Config is the configuration of Runner, tagged for github.com/jessevdk/go-flags.
+// Library callers should start from DefaultConfig, which has the defaults of the flags. Values are used as is,
+// except empty NextPageTokenField and PageTokenParam, whose defaults depend on Xml.
+type Config struct {
+	BillingProject            string        `long:"billing-project" env:"GCLOUD_BILLING_QUOTA_PROJECT"`
+	QuotaHeaderName           string        `long:"quota-header-name" description:"Header to send --billing-project in" default:"x-goog-user-project"`
+	Project                   string        `long:"project" description:"Project ID bound to $project in jq filters, which is null if not set"`
+	Location                  string        `long:"location" description:"Location like us-central1 bound to $location in jq filters and used by regional_host, which is null if not set"`
+	Args                      []string      `long:"arg" description:"Bind $name to the string value in jq filters as name=value, can be repeated"`
+	ArgJSON                   []string      `long:"argjson" description:"Bind $name to the JSON value in jq filters as name=json, can be repeated"`
+	JqLibrary                 []string      `long:"jq-library" description:"jq file of function definitions available in all jq filters, can be repeated"`
+	Headers                   []string      `long:"header" description:"Request header as \"Key: Value\", can be repeated. $VAR and ${VAR} in values are expanded from environment"`
+	HeaderExpr                string        `long:"header-expr" description:"Request headers generator written by jq filter, which yields an object of header name to value. Overrides --header" unquote:"false"`
+	RequestReason             string        `long:"request-reason" description:"X-Goog-Request-Reason header of every request for justification logging of audited APIs. $VAR and ${VAR} are expanded from environment"`
+	UserAgent                 string        `long:"user-agent" description:"User-Agent header of every request, overriding --header and --header-expr"`
+	AppendUserAgent           bool          `long:"append-user-agent" description:"Append --user-agent to the User-Agent of --header, --header-expr or request objects, or to the default of Go, instead of replacing it"`
+	Queries                   []string      `long:"query" description:"Query parameter as key=value added unless the URL already has it, can be repeated"`
+	QueryExpr                 string        `long:"query-expr" description:"Query parameters generator written by jq filter, which yields an object of name to value or array of values. Overrides --query" unquote:"false"`
+	Fields                    string        `long:"fields" description:"Field mask of partial response, which always includes the collection and the next page token when paging"`
+	ImpersonateServiceAccount string        `long:"impersonate-service-account" description:"Service account to impersonate"`
+	ImpersonateDelegates      []string      `long:"impersonate-delegates" description:"Delegation chain of service accounts for --impersonate-service-account"`
+	Scopes                    []string      `long:"scope" description:"OAuth scope of credentials, can be repeated (default: cloud-platform for impersonation and --credentials-file)"`
+	CredentialsFile           string        `long:"credentials-file" description:"JSON credentials file to use instead of Application Default Credentials"`
+	AccessToken               string        `long:"access-token" env:"GOOGLE_OAUTH_ACCESS_TOKEN" description:"Access token to use instead of Application Default Credentials"`
+	EndpointOverride          string        `long:"endpoint-override" description:"Replace host of every request URL by host:port, e.g. for emulators"`
+	Plaintext                 bool          `long:"plaintext" description:"Use http instead of https with --endpoint-override"`
+	NoAuth                    bool          `long:"no-auth" description:"Send requests without credentials, taking precedence over other credential flags"`
+	InsecureSkipTLSVerify     bool          `long:"insecure-skip-tls-verify" description:"Skip TLS certificate verification for test endpoints, never use it in production"`
+	MaxResponseSize           int64         `long:"max-response-size" description:"Fail a response whose body, also after decoding Content-Encoding, exceeds the bytes instead of reading all of it into memory"`
+	RetryOversizedResponse    bool          `long:"retry-oversized-response" description:"Retry responses exceeding --max-response-size, e.g. of flaky proxies, instead of failing the URL"`
+	ClientCert                string        `long:"client-cert" description:"PEM file of the TLS client certificate for endpoints requiring mTLS, with --client-key"`
+	ClientKey                 string        `long:"client-key" description:"PEM file of the private key of --client-cert"`
+	Proxy                     string        `long:"proxy" description:"Proxy URL of http, https or socks5 scheme, overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY"`
+	MaxIdleConns              int           `long:"max-idle-conns" description:"Number of idle connections kept for reuse for each host (default: --parallelism if more than 2)"`
+	MaxConnsPerHost           int           `long:"max-conns-per-host" description:"Limit of connections to each host including those in use (0 means unlimited)"`
+	NoCompression             bool          `long:"no-compression" description:"Don't request compressed responses by Accept-Encoding: gzip, deflate"`
+	StrictJSON                bool          `long:"strict-json" description:"Abort the run on a response body which isn't JSON instead of emitting {rawBody, contentType}"`
+	Xml                       bool          `long:"xml" description:"Parse responses as XML like the Cloud Storage XML API, converting the root element to an object of its child elements and texts"`
+	Parallelism               int64         `long:"parallelism" default:"1"`
+	FlushInterval             time.Duration `long:"flush-interval" description:"Interval to fsync output files, --error-output and files of --output-file-expr for durability of long runs, and on completion"`
+	Ordered                   bool          `long:"ordered" description:"Emit results in the order of urls even with --parallelism, buffering results of later urls in memory"`
+	LogHttp                   bool          `long:"log-http"`
+	LogFormat                 string        `long:"log-format" description:"Format of logs, json is a line of Cloud Logging structured logging for each entry" default:"text" choice:"text" choice:"json"`
+	LogLevel                  string        `long:"log-level" description:"Lowest level of logs, debug includes each request" default:"info" choice:"debug" choice:"info" choice:"warn" choice:"error"`
+	RateLimit                 int           `long:"rate-limit-per-minute"`
+	RateLimitBurst            int           `long:"rate-limit-burst" description:"Number of requests allowed at once after idle time of --rate-limit-per-minute, not applied to --adaptive-rate-limit" default:"10"`
+	RateLimitPerHost          bool          `long:"rate-limit-per-host" description:"Apply --rate-limit-per-minute to each host of request URLs instead of all requests"`
+	AdaptiveRateLimit         bool          `long:"adaptive-rate-limit" description:"Start at --rate-limit-per-minute, halve the rate on 429 and 403 rateLimitExceeded, and ramp it back up on other responses"`
+	CircuitBreakerThreshold   int           `long:"circuit-breaker-threshold" description:"Fail requests to a host immediately for --circuit-breaker-cooldown after the number of consecutive failures of the host"`
+	CircuitBreakerCooldown    time.Duration `long:"circuit-breaker-cooldown" description:"Duration to keep a circuit of --circuit-breaker-threshold open" default:"30s"`
+	Url                       []string      `long:"url" description:"URL generator written by jq filter, which yields URL strings or request objects of {url, method, body, headers, query}. Can be repeated to run every filter for each input (default: .)" unquote:"false"`
+	ExpandEnv                 bool          `long:"expand-env" description:"Expand ${NAME} in --url by environment variables before parsing, leaving $name for jq variables"`
+	Body                      string        `long:"body" description:"Request body generator written by jq filter, encoded as JSON" unquote:"false"`
+	PageTokenInBody           bool          `long:"page-token-in-body" description:"Send pageToken in the request body instead of the query string"`
+	PageTokenBodyKey          string        `long:"page-token-body-key" description:"Key of pageToken in the request body" default:"pageToken"`
+	Method                    string        `long:"method" description:"HTTP method of requests" default:"GET" choice:"GET" choice:"POST" choice:"PUT" choice:"PATCH" choice:"DELETE"`
+	Download                  string        `long:"download" description:"Write bodies of 200 responses into the file path generated by jq filter against the input, like alt=media of Cloud Storage, and emit {file, size} as the response" unquote:"false"`
+	WaitOperation             bool          `long:"wait-operation" description:"Poll the long-running operation of each response until done, and emit the final operation"`
+	OperationUrlExpr          string        `long:"operation-url-expr" description:"URL of the operation to poll generated by jq filter against the operation (default: selfLink, or name under the API version of the request URL)" unquote:"false"`
+	Execute                   bool          `long:"execute" description:"Execute without dry-run"`
+	DryRunOutput              bool          `long:"dry-run-output" description:"Emit planned requests of dry-run as {input, method, url, headers, body} records instead of logging them"`
+	Verbose                   bool          `long:"verbose" description:"Same as --log-level=debug"`
+	Progress                  bool          `long:"progress" description:"Log the number of inputs done and in flight, urls, requests and retries periodically and on completion"`
+	ProgressInterval          time.Duration `long:"progress-interval" description:"Interval of --progress" default:"10s"`
+	BackoffStrategy           string        `long:"backoff-strategy" description:"Intervals of retries, exponential grows from --backoff-min to --backoff-max with --backoff-jitter, full-jitter is random up to the exponential interval, decorrelated is random from --backoff-min to 3 times the previous interval, and constant is --backoff-min with --backoff-jitter" default:"exponential" choice:"exponential" choice:"full-jitter" choice:"decorrelated" choice:"constant"`
+	BackoffMin                time.Duration `long:"backoff-min" description:"Minimum interval of retries" default:"1s"`
+	BackoffMax                time.Duration `long:"backoff-max" description:"Maximum interval of retries" default:"1m"`
+	BackoffJitter             float64       `long:"backoff-jitter" description:"Jitter factor of retry intervals between 0 and 1" default:"0.1"`
+	MaxRetries                int           `long:"backoff-max-retries" description:"Maximum number of retries on 429, 5xx and 403 rateLimitExceeded responses (0 means unlimited)" default:"10"`
+	RetryBudget               int           `long:"retry-budget" description:"Maximum number of retries of all urls, pages and follow-ups of an input, failing the rest of its requests once spent (0 means unlimited)"`
+	RequestTimeout            time.Duration `long:"request-timeout" description:"Timeout of each request including reading the body, retried on expiry"`
+	CacheFile                 string        `long:"cache-file" description:"File to cache responses of GET with ETag by URL, sending If-None-Match and reusing the body on 304"`
+	Dedupe                    bool          `long:"dedupe" description:"Send only one of identical requests in flight and share the response among inputs"`
+	DedupeCache               bool          `long:"dedupe-cache" description:"Keep responses of --dedupe for the run to share them with later identical requests"`
+	Timeout                   time.Duration `long:"timeout" description:"Timeout of the whole run, exits with 124 on expiry"`
+	CheckpointFile            string        `long:"checkpoint-file" description:"File to append keys of inputs completed successfully, and to skip inputs of the recorded keys on restart"`
+	CheckpointKey             string        `long:"checkpoint-key" description:"Key of inputs in --checkpoint-file generated by jq filter (default: sequence number of the input)" unquote:"false"`
+	CollectionName            string        `long:"collection" description:"Collection name in favor of AIP-132 for paging, as a dotted path or jq filter (exclusive with --auto-collection)"`
+	AutoCollection            bool          `long:"auto-collection" description:"Infer collection name for paging from the first page, which is the last element of the URL path or the only array field (exclusive with --collection)"`
+	DeepCollection            bool          `long:"deep-collection" description:"With --auto-collection, also search nested objects for the collection, preferring the array next to the next page token"`
+	Aggregated                bool          `long:"aggregated" description:"Collect the collection from each scope of items map like aggregatedList of Compute Engine"`
+	MergeFields               bool          `long:"merge-fields" description:"Keep fields other than the collection and paging fields in the response, the first value of each or arrays concatenated across pages"`
+	AggregatedScopeField      string        `long:"aggregated-scope-field" description:"Field name to store the scope key into each item with --aggregated"`
+	NextPageTokenField        string        `long:"next-page-token-field" description:"Field of the next page token, as a dotted path or jq filter (default: nextPageToken, or NextMarker with --xml)"`
+	PageTokenParam            string        `long:"page-token-param" description:"Query parameter name of the page token (default: pageToken, or marker with --xml)"`
+	NextLinkField             string        `long:"next-link-field" description:"Field of the full URL of the next page like nextLink, as a dotted path or jq filter, requested as is instead of --next-page-token-field"`
+	Pagination                string        `long:"pagination" description:"How to find the next page, page-token follows --next-page-token-field, link-header follows rel=\"next\" of Link header and offset advances --offset-param by the number of items until a short or empty page" default:"page-token" choice:"page-token" choice:"link-header" choice:"offset"`
+	PageSize                  int           `long:"page-size" description:"Page size of each request, unless the URL already has the parameter"`
+	PageSizeParam             string        `long:"page-size-param" description:"Query parameter name of --page-size" default:"pageSize"`
+	OffsetParam               string        `long:"offset-param" description:"Query parameter name of the offset with --pagination=offset" default:"offset"`
+	LimitParam                string        `long:"limit-param" description:"Query parameter name of --page-size with --pagination=offset" default:"limit"`
+	MaxPages                  int           `long:"max-pages" description:"Stop paging after the number of pages per URL"`
+	MaxItems                  int           `long:"max-items" description:"Stop paging after the number of collection items per URL"`
+	Sample                    int           `long:"sample" description:"Stop reading inputs after the number of inputs are dispatched to try filters on a few inputs, unlike --max-items limiting items of each URL"`
+	Flatten                   bool          `long:"flatten" description:"Emit each collection item as its own record as pages arrive"`
+	FlattenWithInput          bool          `long:"flatten-with-input" description:"Emit {input, item} records instead of bare items with --flatten"`
+	Count                     bool          `long:"count" description:"Emit {input, count} records of the number of collection items of all pages instead of the items"`
+	TotalSizeField            string        `long:"total-size-field" description:"Field of the total number of items in the first page like totalSize, as a dotted path or jq filter, used by --count instead of paging or by --page-parallelism if present"`
+	PageParallelism           int           `long:"page-parallelism" description:"Number of pages of each URL fetched at once with --pagination=offset after --total-size-field of the first page is known"`
+	Stream                    bool          `long:"stream" description:"Emit a record per page as pages arrive instead of buffering all pages"`
+	DedupeItemsBy             string        `long:"dedupe-items-by" description:"Drop collection items whose key generated by jq filter is already seen in pages of the URL, applied before --select" unquote:"false"`
+	Select                    string        `long:"select" description:"Keep collection items for which jq filter yields true, applied before --map" unquote:"false"`
+	ThenUrl                   string        `long:"then-url" description:"Generate URLs of follow-up GET requests by jq filter against each collection item, whose results are attached as then of the record" unquote:"false"`
+	Map                       string        `long:"map" description:"Transform each collection item by jq filter, all results are kept" unquote:"false"`
+	YamlInput                 bool          `long:"yaml-input"`
+	BatchSize                 int           `long:"batch-size" description:"Group the number of consecutive inputs into an array input, also bound to $batch in --url and --body, to send a request for each group to batch APIs"`
+	JsonArrayInput            bool          `long:"json-array-input" description:"Read each element of JSON arrays as an input, streaming a large array without loading it at once"`
+	RawInput                  bool          `long:"raw-input"`
+	CsvInput                  bool          `long:"csv-input" description:"Read CSV with a header row, each row is an object keyed by the header"`
+	TsvInput                  bool          `long:"tsv-input" description:"Read TSV with a header row, each row is an object keyed by the header. Quotes are not interpreted"`
+	Delimiter                 string        `long:"delimiter" description:"Field delimiter of --csv-input" default:","`
+	IncludeError              bool          `long:"include-error"`
+	ErrorOutput               string        `long:"error-output" description:"File to write failed inputs as {input, status, response} records instead of stdout"`
+	FailOnError               bool          `long:"fail-on-error" description:"Count non-200 responses after retries as failed urls, exits with 2 if some urls failed and 3 if all"`
+	YamlOutput                bool          `long:"yaml-output"`
+	NoInput                   bool          `long:"no-input" description:"Omit input from records except --error-output to reduce the output size of large inputs"`
+	Timings                   bool          `long:"timings" description:"Add durationMs of the wall time of all pages and pageCount of fetched pages to records of responses and --count"`
+	InputExpr                 string        `long:"input-expr" description:"Replace input of records except --error-output by jq filter against the input, e.g. a key of the input" unquote:"false"`
+	RawOutput                 bool          `long:"raw-output" description:"Write string records as is followed by a newline instead of encoding them, like jq -r"`
+	YamlSeqOutput             bool          `long:"yaml-seq-output" description:"Output a single YAML sequence of all records instead of a document for each, buffering all records in memory until the end"`
+	OutputFileExpr            string        `long:"output-file-expr" description:"Output file path generator written by jq filter, evaluated against each input to shard output into files" unquote:"false"`
+	Ndjson                    bool          `long:"ndjson" description:"Output newline-delimited JSON, exactly one compact JSON value per line"`
+	Indent                    int           `long:"indent" description:"Indent output by the number of spaces (default: compact JSON, 4 for YAML)"`
+	OutputExpr                string        `long:"output-expr" description:"Transform each output record by jq filter before encoding, all results are emitted" unquote:"false"`
+}
+
+func countTrue(bs ...bool) int {
+	var n int
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// Validate reports conflicting or incomplete settings.
+func (c *Config) Validate() error {
+	if err := c.validateChoices(); err != nil {
+		return err
+	}
+	if c.Parallelism < 1 {
+		return fmt.Errorf("--parallelism must be positive: %v", c.Parallelism)
+	}
+	if c.Progress && c.ProgressInterval <= 0 {
+		return fmt.Errorf("--progress-interval must be positive: %v", c.ProgressInterval)
+	}
+	if countTrue(c.YamlInput, c.JsonArrayInput, c.RawInput, c.CsvInput, c.TsvInput) > 1 {
+		return errors.New("--yaml-input, --json-array-input, --raw-input, --csv-input and --tsv-input are exclusive")
+	}
+	if utf8.RuneCountInString(c.Delimiter) != 1 {
+		return fmt.Errorf("--delimiter must be a single character: %q", c.Delimiter)
+	}
+	if c.BackoffMin > c.BackoffMax {
+		return fmt.Errorf("--backoff-min must not exceed --backoff-max: %v > %v", c.BackoffMin, c.BackoffMax)
+	}
+	if c.BackoffJitter < 0 || c.BackoffJitter > 1 {
+		return fmt.Errorf("--backoff-jitter must be between 0 and 1: %v", c.BackoffJitter)
+	}
+	if c.RateLimitBurst < 0 {
+		return fmt.Errorf("--rate-limit-burst must not be negative: %v", c.RateLimitBurst)
+	}
+	if c.MaxIdleConns < 0 || c.MaxConnsPerHost < 0 {
+		return errors.New("--max-idle-conns and --max-conns-per-host must not be negative")
+	}
+	if c.Sample < 0 {
+		return fmt.Errorf("--sample must not be negative: %v", c.Sample)
+	}
+	if c.RetryBudget < 0 {
+		return fmt.Errorf("--retry-budget must not be negative: %v", c.RetryBudget)
+	}
+	if c.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("--circuit-breaker-threshold must not be negative: %v", c.CircuitBreakerThreshold)
+	}
+	if c.CircuitBreakerCooldown < 0 {
+		return fmt.Errorf("--circuit-breaker-cooldown must not be negative: %v", c.CircuitBreakerCooldown)
+	}
+	if c.AdaptiveRateLimit && c.RateLimit == 0 {
+		return errors.New("--adaptive-rate-limit requires --rate-limit-per-minute")
+	}
+	if c.RateLimitPerHost && c.RateLimit == 0 {
+		return errors.New("--rate-limit-per-host requires --rate-limit-per-minute")
+	}
+	if c.ThenUrl != "" && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--then-url requires --collection or --auto-collection")
+	}
+	if c.ThenUrl != "" && (c.Flatten || c.Stream || c.Count) {
+		return errors.New("--then-url is exclusive with --flatten, --stream and --count")
+	}
+	if c.DeepCollection && !c.AutoCollection {
+		return errors.New("--deep-collection requires --auto-collection")
+	}
+	if c.AutoCollection && c.CollectionName != "" {
+		return errors.New("--auto-collection and --collection are exclusive")
+	}
+	if c.NoInput && (c.InputExpr != "" || c.FlattenWithInput) {
+		return errors.New("--no-input is exclusive with --input-expr and --flatten-with-input")
+	}
+	if c.RawOutput && c.YamlSeqOutput {
+		return errors.New("--raw-output and --yaml-seq-output are exclusive")
+	}
+	if c.Ndjson && (c.YamlOutput || c.YamlSeqOutput || c.Indent > 0) {
+		return errors.New("--ndjson is exclusive with --yaml-output, --yaml-seq-output and --indent")
+	}
+	if c.Location != "" && !locationPattern.MatchString(c.Location) {
+		return fmt.Errorf("invalid --location, must be like us-central1, us-central1-a or global: %v", c.Location)
+	}
+	if c.MaxResponseSize < 0 {
+		return fmt.Errorf("--max-response-size must not be negative: %v", c.MaxResponseSize)
+	}
+	if c.RetryOversizedResponse && c.MaxResponseSize == 0 {
+		return errors.New("--retry-oversized-response requires --max-response-size")
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return errors.New("--client-cert and --client-key must be set together")
+	}
+	if c.AccessToken != "" && c.CredentialsFile != "" {
+		return errors.New("--access-token and --credentials-file are exclusive")
+	}
+	if strings.Contains(c.EndpointOverride, "/") {
+		return fmt.Errorf("--endpoint-override must be host:port: %v", c.EndpointOverride)
+	}
+	if c.Plaintext && c.EndpointOverride == "" {
+		return errors.New("--plaintext requires --endpoint-override")
+	}
+	if c.AppendUserAgent && c.UserAgent == "" {
+		return errors.New("--append-user-agent requires --user-agent")
+	}
+	if len(c.ImpersonateDelegates) > 0 && c.ImpersonateServiceAccount == "" {
+		return errors.New("--impersonate-delegates requires --impersonate-service-account")
+	}
+	if c.Aggregated && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--aggregated requires --collection or --auto-collection")
+	}
+	if c.Flatten && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--flatten requires --collection or --auto-collection")
+	}
+	if c.Stream && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--stream requires --collection or --auto-collection")
+	}
+	if c.Count && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--count requires --collection or --auto-collection")
+	}
+	if c.Download != "" && (c.CollectionName != "" || c.AutoCollection || c.WaitOperation || c.Xml) {
+		return errors.New("--download is exclusive with --collection, --auto-collection, --wait-operation and --xml")
+	}
+	if c.Count && (c.Flatten || c.Stream) {
+		return errors.New("--count is exclusive with --flatten and --stream")
+	}
+	if c.TotalSizeField != "" && !c.Count && c.PageParallelism <= 1 {
+		return errors.New("--total-size-field requires --count or --page-parallelism")
+	}
+	if c.PageParallelism > 1 && (c.Pagination != paginationOffset || c.PageSize <= 0 || c.TotalSizeField == "") {
+		return errors.New("--page-parallelism requires --pagination=offset, --page-size and --total-size-field")
+	}
+	if c.NextLinkField != "" && c.Pagination != paginationPageToken {
+		return fmt.Errorf("--next-link-field can't be used with --pagination=%v", c.Pagination)
+	}
+	if c.NextLinkField != "" && c.PageTokenInBody {
+		return errors.New("--next-link-field and --page-token-in-body are exclusive")
+	}
+	if c.Pagination != paginationPageToken && c.PageTokenInBody {
+		return fmt.Errorf("--page-token-in-body can't be used with --pagination=%v", c.Pagination)
+	}
+	if c.WaitOperation && (c.AutoCollection || c.CollectionName != "") {
+		return errors.New("--wait-operation can't be used with --collection or --auto-collection")
+	}
+	if c.OperationUrlExpr != "" && !c.WaitOperation {
+		return errors.New("--operation-url-expr requires --wait-operation")
+	}
+	if c.DedupeCache && !c.Dedupe {
+		return errors.New("--dedupe-cache requires --dedupe")
+	}
+	if c.CheckpointKey != "" && c.CheckpointFile == "" {
+		return errors.New("--checkpoint-key requires --checkpoint-file")
+	}
+	if c.DedupeItemsBy != "" && !c.AutoCollection && c.CollectionName == "" {
+		return errors.New("--dedupe-items-by requires --collection or --auto-collection")
+	}
+	if c.Stream && c.Flatten {
+		return errors.New("--stream and --flatten are exclusive")
+	}
+	if c.DryRunOutput && c.Execute {
+		return errors.New("--dry-run-output and --execute are exclusive")
+	}
+	return nil
+}
+
+// DefaultConfig returns a Config with the defaults of flags, which library callers should start from.
+func DefaultConfig() Config {
+	var c Config
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		def, ok := v.Type().Field(i).Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		if err := setFlagValue(v.Field(i), def); err != nil {
+			// defaults are constants of the tags
+			panic(fmt.Sprintf("invalid default of %v: %v", v.Type().Field(i).Name, err))
+		}
+	}
+	return c
+}
+
+// setFlagValue sets s parsed like go-flags into f.
+func setFlagValue(f reflect.Value, s string) error {
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %v", f.Type())
+	}
+	return nil
+}
+
+// validateChoices checks fields of the choice tags, which go-flags checks only for flags.
+func (c *Config) validateChoices() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		choices := choicesOf(field.Tag)
+		if len(choices) == 0 {
+			continue
+		}
+		value := v.Field(i).String()
+		var ok bool
+		for _, choice := range choices {
+			ok = ok || value == choice
+		}
+		if !ok {
+			return fmt.Errorf("invalid --%v, must be one of %v: %q", field.Tag.Get("long"), strings.Join(choices, ", "), value)
+		}
+	}
+	return nil
+}
+
+// choicesOf returns all values of the repeated choice key in tag, which reflect.StructTag.Get doesn't.
+func choicesOf(tag reflect.StructTag) []string {
+	var choices []string
+	for s := string(tag); s != ""; {
+		i := strings.Index(s, `choice:"`)
+		if i < 0 {
+			break
+		}
+		s = s[i+len(`choice:"`):]
+		j := strings.Index(s, `"`)
+		if j < 0 {
+			break
+		}
+		choices = append(choices, s[:j])
+		s = s[j+1:]
+	}
+	return choices
+}
+
+// withDefaults fills defaults depending on other fields, which DefaultConfig can't have.
+// Other values are used as is.
+func (c Config) withDefaults() Config {
+	if c.Verbose {
+		c.LogLevel = "debug"
+	}
+	if c.NextPageTokenField == "" {
+		c.NextPageTokenField = "nextPageToken"
+		if c.Xml {
+			c.NextPageTokenField = "NextMarker"
+		}
+	}
+	if c.PageTokenParam == "" {
+		c.PageTokenParam = "pageToken"
+		if c.Xml {
+			c.PageTokenParam = "marker"
+		}
+	}
+	return c
+}
+
+// Runner runs requests of a Config. All expressions are compiled in New so a Runner can be reused.
+type Runner struct {
+	config        Config
+	client        *http.Client
+	tokens        *refreshingTokenSource // nil if tokens can't be refreshed
+	rl            ratelimit.Limiter
+	hostRl        *hostLimiter        // nil unless --rate-limit-per-host
+	breaker       *hostBreaker        // nil unless --circuit-breaker-threshold
+	thenSem       *semaphore.Weighted // follow-ups of all urls, nil unless --then-url
+	backoffPolicy backoff.Policy
+	muStderr      sync.Mutex
+	logger        *logger
+	progress      *progress
+
+	urlCodes          []*query
+	headers           http.Header
+	headerCode        *query
+	staticQuery       url.Values
+	queryCode         *query
+	collectionExpr    *fieldExpr
+	nextPageTokenExpr *fieldExpr
+	nextLinkExpr      *fieldExpr
+	totalSizeExpr     *fieldExpr
+	dedupeItemsCode   *query
+	checkpointKeyCode *query
+	selectCode        *query
+	mapCode           *query
+	outputFileCode    *query
+	inputCode         *query
+	downloadCode      *query
+	thenUrlCode       *query
+	outputCode        *query
+	operationUrlCode  *query
+	bodyCode          *query
+}
+
+// New validates config, compiles its expressions and creates an authorized client.
+// ctx is used to find credentials.
+func New(ctx context.Context, config Config) (*Runner, error) {
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Runner{config: config, logger: newLogger(config.LogFormat, config.LogLevel), progress: &progress{}}
+
+	newLimiter := func() ratelimit.Limiter {
+		if config.RateLimit == 0 {
+			return ratelimit.NewUnlimited()
+		}
+		if config.AdaptiveRateLimit {
+			return newAdaptiveLimiter(config.RateLimit)
+		}
+		return ratelimit.New(config.RateLimit, ratelimit.Per(time.Minute), ratelimit.WithSlack(config.RateLimitBurst))
+	}
+	r.rl = newLimiter()
+	if config.RateLimitPerHost {
+		r.hostRl = newHostLimiter(newLimiter)
+	}
+	if config.CircuitBreakerThreshold > 0 {
+		r.breaker = newHostBreaker(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown)
+	}
+
+	r.backoffPolicy = newBackoffPolicy(config)
+
+	env, err := newJQEnv(config.Project, config.Location, config.Args, config.ArgJSON, config.JqLibrary)
+	if err != nil {
+		return nil, err
+	}
+	// env of --url and --body
+	requestEnv := env
+	if config.BatchSize > 0 {
+		for _, name := range env.names {
+			if name == "$batch" {
+				return nil, errors.New("$batch of --arg and --argjson is reserved for --batch-size")
+			}
+		}
+		requestEnv = env.withInputVariable("$batch")
+	}
+	urls := config.Url
+	if len(urls) == 0 {
+		// inputs are URLs
+		urls = []string{"."}
+	}
+	for _, u := range urls {
+		if config.ExpandEnv {
+			var err error
+			u, err = expandEnv(u)
+			if err != nil {
+				return nil, err
+			}
+		}
+		code, err := compileQuery(u, requestEnv)
+		if err != nil {
+			return nil, err
+		}
+		r.urlCodes = append(r.urlCodes, code)
+	}
+
+	r.headers, err = parseHeaders(config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if config.RequestReason != "" {
+		reason := os.ExpandEnv(config.RequestReason)
+		if reason == "" {
+			return nil, fmt.Errorf("--request-reason is empty after expanding environment variables: %v", config.RequestReason)
+		}
+		r.headers.Set("X-Goog-Request-Reason", reason)
+	}
+
+	r.staticQuery, err = parseQueries(config.Queries)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CollectionName != "" {
+		r.collectionExpr, err = compileFieldExpr(config.CollectionName, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.nextPageTokenExpr, err = compileFieldExpr(config.NextPageTokenField, env)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.NextLinkField != "" {
+		r.nextLinkExpr, err = compileFieldExpr(config.NextLinkField, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.TotalSizeField != "" {
+		r.totalSizeExpr, err = compileFieldExpr(config.TotalSizeField, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.HeaderExpr != "" {
+		r.headerCode, err = compileQuery(config.HeaderExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.QueryExpr != "" {
+		r.queryCode, err = compileQuery(config.QueryExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DedupeItemsBy != "" {
+		r.dedupeItemsCode, err = compileQuery(config.DedupeItemsBy, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.CheckpointKey != "" {
+		r.checkpointKeyCode, err = compileQuery(config.CheckpointKey, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Select != "" {
+		r.selectCode, err = compileQuery(config.Select, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Map != "" {
+		r.mapCode, err = compileQuery(config.Map, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Download != "" {
+		r.downloadCode, err = compileQuery(config.Download, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ThenUrl != "" {
+		r.thenUrlCode, err = compileQuery(config.ThenUrl, env)
+		if err != nil {
+			return nil, err
+		}
+		r.thenSem = semaphore.NewWeighted(config.Parallelism)
+	}
+
+	if config.InputExpr != "" {
+		r.inputCode, err = compileQuery(config.InputExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OutputFileExpr != "" {
+		r.outputFileCode, err = compileQuery(config.OutputFileExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OperationUrlExpr != "" {
+		r.operationUrlCode, err = compileQuery(config.OperationUrlExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OutputExpr != "" {
+		r.outputCode, err = compileQuery(config.OutputExpr, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Body != "" {
+		r.bodyCode, err = compileQuery(config.Body, requestEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.client, r.tokens, err = newClient(ctx, config, r.logger)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run reads inputs from in, calls APIs for each URL generated from the inputs, and writes records into out.
+// Failures of each URL are logged and counted without stopping others, and reported as an error at last.
+func (r *Runner) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	// sequences of --yaml-seq-output written by closeSeqs
+	var seqEncs []*yamlSeqEncoder
+	closeSeqs := func() error {
+		defer func() {
+			seqEncs = nil
+		}()
+		for _, enc := range seqEncs {
+			if err := enc.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	newFormatEncoder := func(w io.Writer) encoder {
+		if r.config.Ndjson {
+			return &ndjsonEncoder{w}
+		}
+		if r.config.YamlOutput || r.config.YamlSeqOutput {
+			enc := yaml.NewEncoder(w)
+			if r.config.Indent > 0 {
+				enc.SetIndent(r.config.Indent)
+			}
+			if r.config.YamlSeqOutput {
+				seqEnc := &yamlSeqEncoder{enc: enc}
+				seqEncs = append(seqEncs, seqEnc)
+				return seqEnc
+			}
+			return enc
+		}
+		enc := json.NewEncoder(w)
+		if r.config.Indent > 0 {
+			enc.SetIndent("", strings.Repeat(" ", r.config.Indent))
+		}
+		return enc
+	}
+	newEncoder := func(w io.Writer) encoder {
+		if r.config.RawOutput {
+			return &rawStringEncoder{w: w, enc: newFormatEncoder(w)}
+		}
+		return newFormatEncoder(w)
+	}
+	// records go only to shards with --output-file-expr, and an empty sequence of --yaml-seq-output isn't written to out
+	var enc encoder
+	if r.outputFileCode == nil {
+		enc = newEncoder(out)
+	}
+
+	ckpt, err := r.openCheckpoint()
+	if err != nil {
+		return err
+	}
+	if ckpt != nil {
+		// deferred first to be closed after draining results
+		defer ckpt.close()
+	}
+
+	// encoders of --output-file-expr keyed by path, writing into files of shards
+	shardEncs := make(map[string]encoder)
+	shards := newShardPool(maxOpenShards, r.config.FlushInterval > 0 || ckpt != nil)
+	defer shards.closeAll()
+
+	var errEnc encoder
+	var errFile *os.File
+	if r.config.ErrorOutput != "" {
+		f, err := os.Create(r.config.ErrorOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		errEnc = newEncoder(f)
+		errFile = f
+	}
+	// write records received before an error, before closing files
+	defer closeSeqs()
+
+	// flush syncs the output files by --flush-interval
+	flush := func() error {
+		if err := syncFile(out); err != nil {
+			return err
+		}
+		if errFile != nil {
+			if err := syncFile(errFile); err != nil {
+				return err
+			}
+		}
+		return shards.syncAll()
+	}
+	// keys are checkpoint keys of inputs whose records are encoded, recorded by commit
+	var keys []string
+	// commit syncs the output files and records keys, so a resumed run skips only inputs with records on the disk
+	commit := func() error {
+		if err := flush(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := ckpt.record(key); err != nil {
+				return fmt.Errorf("failed to record checkpoint: %w", err)
+			}
+		}
+		keys = nil
+		return nil
+	}
+	var flushTick <-chan time.Time
+	if r.config.FlushInterval > 0 {
+		t := time.NewTicker(r.config.FlushInterval)
+		defer t.Stop()
+		flushTick = t.C
+	}
+
+	// encode writes v into the shard file of path, or the output if path is empty.
+	encode := func(path string, v interface{}) error {
+		vs := []interface{}{v}
+		if r.outputCode != nil {
+			jv, err := toJSONValue(v)
+			if err != nil {
+				return err
+			}
+			vs, err = runAll(r.outputCode, jv)
+			if err != nil {
+				return err
+			}
+		}
+		enc := enc
+		if path != "" {
+			var ok bool
+			if enc, ok = shardEncs[path]; !ok {
+				enc = newEncoder(shards.shard(path))
+				shardEncs[path] = enc
+			}
+		}
+		for _, v := range vs {
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := r.startStream(ctx, in, ckpt)
+	var runErr error
+	// drain results on early return so that Stream can finish
+	defer func() {
+		cancel()
+		for range results {
+		}
+	}()
+	for {
+		var res Result
+		var ok bool
+		select {
+		case res, ok = <-results:
+		case <-flushTick:
+			// records of --yaml-seq-output are written only on completion
+			commitKeys := commit
+			if r.config.YamlSeqOutput {
+				commitKeys = flush
+			}
+			if err := commitKeys(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		if res.RunErr != nil {
+			// the last Result, after which records and keys of completed inputs are committed
+			runErr = res.RunErr
+			continue
+		}
+		if res.checkpointKey != "" {
+			keys = append(keys, res.checkpointKey)
+			if r.config.FlushInterval == 0 && !r.config.YamlSeqOutput {
+				if err := commit(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var outputPath string
+		if r.outputFileCode != nil {
+			v, err := runFirst(r.outputFileCode, res.Input)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			if outputPath, ok = v.(string); !ok || outputPath == "" {
+				return fmt.Errorf("output file path must be a non-empty string: %v", v)
+			}
+		}
+
+		var urlIndex *int
+		if len(r.urlCodes) > 1 {
+			urlIndex = &res.UrlIndex
+		}
+
+		// input of records, which is the whole input in --error-output to retry
+		fullInput := &res.Input
+		var input *interface{}
+		switch {
+		case r.config.NoInput:
+		case r.inputCode != nil:
+			v, err := runFirst(r.inputCode, res.Input)
+			if err != nil {
+				return err
+			}
+			input = &v
+		default:
+			input = fullInput
+		}
+
+		var err error
+		switch {
+		case res.Request != nil:
+			var record requestOutput
+			record, err = newRequestOutput(input, res.Index, urlIndex, res.Request)
+			if err == nil {
+				err = encode(outputPath, record)
+			}
+		case res.Status == 0:
+			if errEnc != nil {
+				err = errEnc.Encode(output{Input: fullInput, Index: res.Index, URL: res.URL, UrlIndex: urlIndex, Error: res.Err.Error()})
+			}
+		case res.Status != http.StatusOK:
+			record := output{
+				Input:      input,
+				Index:      res.Index,
+				URL:        res.URL,
+				UrlIndex:   urlIndex,
+				Response:   res.Response,
+				Status:     res.Status,
+				StatusText: http.StatusText(res.Status),
+			}
+			record.DurationMs, record.PageCount = timings(res, r.config.Timings)
+			if errEnc != nil {
+				record.Input = fullInput
+				err = errEnc.Encode(record)
+			} else if r.config.IncludeError {
+				err = encode(outputPath, record)
+			}
+		case r.config.Count:
+			record := countOutput{Input: input, Index: res.Index, URL: res.URL, UrlIndex: urlIndex, Count: res.Count, Truncated: res.Truncated}
+			record.DurationMs, record.PageCount = timings(res, r.config.Timings)
+			err = encode(outputPath, record)
+		case r.config.Flatten:
+			var record interface{} = res.Item
+			if r.config.FlattenWithInput {
+				record = itemOutput{Input: input, Index: res.Index, URL: res.URL, UrlIndex: urlIndex, Item: res.Item}
+			}
+			err = encode(outputPath, record)
+		default:
+			record := output{
+				Input:      input,
+				Index:      res.Index,
+				URL:        res.URL,
+				UrlIndex:   urlIndex,
+				Response:   res.Response,
+				Status:     res.Status,
+				StatusText: http.StatusText(res.Status),
+				Truncated:  res.Truncated,
+				Then:       newThenOutputs(res.Then),
+			}
+			record.DurationMs, record.PageCount = timings(res, r.config.Timings)
+			err = encode(outputPath, record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := closeSeqs(); err != nil {
+		return err
+	}
+	if r.config.FlushInterval > 0 || len(keys) > 0 {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+	if runErr != nil {
+		return runErr
+	}
+	return ctx.Err()
+}
+
+// Result is a result of a URL generated from an input.
+// With Flatten, a Result is sent for each collection item, and with Stream, for each page.
+type Result struct {
+	Input interface{}
+	// URL is generated by Url without paging parameters.
+	URL string
+	// Index is the sequence number of URL in all URLs of the run, shown as url[Index] in logs.
+	Index int
+	// UrlIndex is the index of the filter in Url which generated URL.
+	UrlIndex int
+	// Response is the response body, or the response with only the collection of all pages when paging.
+	Response interface{}
+	// Item is a collection item with Flatten.
+	Item interface{}
+	// Count is the number of collection items of all pages with Count.
+	Count int
+	// Status is the HTTP status code, or 0 if the request failed without a response.
+	Status int
+	// Truncated reports paging was stopped by MaxPages or MaxItems.
+	Truncated bool
+	// Then is the results of follow-up requests of ThenUrl for items of the collection.
+	Then []ThenResult
+	// Duration is the wall time of the URL including all pages so far, and Pages is the number of pages fetched so far.
+	Duration time.Duration
+	Pages    int
+	// Err is non-nil if Status is not 200.
+	Err error
+	// RunErr is the error of the whole run, only set in the last Result of a failed run whose other fields are empty.
+	RunErr error
+	// Request is the planned request of dry-run with DryRunOutput, and nil otherwise.
+	Request *http.Request
+
+	// checkpointKey is the key of an input in CheckpointFile, set alone in a Result sent after all Results of the input
+	// succeeded, to be recorded once they are written.
+	checkpointKey string
+}
+
+// Stream reads inputs from in and sends results of the API calls into the returned channel, which is closed at the end.
+// If the run fails, including failures of some URLs, the last Result has the error in RunErr.
+// Callers must receive until the channel is closed, or cancel ctx.
+func (r *Runner) Stream(ctx context.Context, in io.Reader) (<-chan Result, error) {
+	ckpt, err := r.openCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	inner := r.startStream(ctx, in, ckpt)
+	if ckpt == nil {
+		return inner, nil
+	}
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		defer ckpt.close()
+		for res := range inner {
+			if res.checkpointKey != "" {
+				// the caller has received all Results of the input
+				if err := ckpt.record(res.checkpointKey); err != nil {
+					r.logger.printf(severityError, "failed to record checkpoint %v: %v", res.checkpointKey, err)
+				}
+				continue
+			}
+			// keep receiving after ctx is done so that inner can finish
+			select {
+			case results <- res:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return results, nil
+}
+
+// openCheckpoint opens CheckpointFile, or returns nil without it.
+func (r *Runner) openCheckpoint() (*checkpoint, error) {
+	if r.config.CheckpointFile == "" {
+		return nil, nil
+	}
+	ckpt, err := openCheckpoint(r.config.CheckpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	return ckpt, nil
+}
+
+// startStream is Stream sending also Results of checkpoint keys, which the caller records into ckpt.
+func (r *Runner) startStream(ctx context.Context, in io.Reader, ckpt *checkpoint) <-chan Result {
+	var dec decoder
+
+	if r.config.RawInput {
+		dec = &lineDecoder{bufio.NewScanner(in)}
+	} else if r.config.CsvInput {
+		cr := csv.NewReader(in)
+		cr.Comma, _ = utf8.DecodeRuneInString(r.config.Delimiter)
+		dec = &csvDecoder{r: cr}
+	} else if r.config.TsvInput {
+		dec = &csvDecoder{r: &tsvReader{bufio.NewScanner(in)}}
+	} else if r.config.YamlInput {
+		dec = yaml.NewDecoder(in)
+	} else if r.config.JsonArrayInput {
+		dec = &jsonArrayDecoder{dec: json.NewDecoder(in)}
+	} else {
+		dec = json.NewDecoder(in)
+	}
+	if r.config.BatchSize > 0 {
+		dec = &batchDecoder{dec: dec, size: r.config.BatchSize}
+	}
+
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		if err := r.stream(ctx, dec, results, ckpt); err != nil {
+			select {
+			case results <- Result{RunErr: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return results
+}
+
+func (r *Runner) stream(ctx context.Context, dec decoder, results chan<- Result, ckpt *checkpoint) error {
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.Timeout)
+		defer cancel()
+	}
+
+	var cache *etagCache
+	if r.config.CacheFile != "" {
+		var err error
+		cache, err = loadETagCache(r.config.CacheFile)
+		if err != nil {
+			return fmt.Errorf("failed to load cache: %w", err)
+		}
+		// deferred before waiting urls so that their responses are saved
+		defer func() {
+			if err := cache.save(); err != nil {
+				r.logger.printf(severityError, "failed to save cache: %v", err)
+			}
+		}()
+	}
+
+	var dedupe *deduper
+	if r.config.Dedupe {
+		dedupe = newDeduper(r.config.DedupeCache)
+	}
+
+	// deferred before waiting urls so that the summary includes all of them
+	if r.config.Progress {
+		defer r.reportProgress()()
+	}
+
+	sem := semaphore.NewWeighted(r.config.Parallelism)
+
+	var count int
+	var failedCount int64
+	ctx, cancel := context.WithCancel(ctx)
+	var ord *reorderer
+	if r.config.Ordered {
+		// ctx before errgroup, which is canceled on return of eg.Wait before flushing
+		ord = newReorderer(ctx, results)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	// wait in-flight urls on early return so that no Result is sent after close
+	defer func() {
+		cancel()
+		eg.Wait()
+		if ord != nil {
+			ord.close()
+		}
+	}()
+	sendResult := func(res Result) error {
+		select {
+		case results <- res:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var inputCount int
+	// dispatched counts inputs not skipped by checkpoint for --sample
+	var dispatched int
+	for {
+		// stop before decoding, so an endless input isn't read any more
+		if r.config.Sample > 0 && dispatched >= r.config.Sample {
+			break
+		}
+		var input interface{}
+		if err := dec.Decode(&input); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		inputIndex := inputCount
+		inputCount++
+
+		var checkpointKey string
+		if ckpt != nil {
+			var v interface{} = inputIndex
+			if r.checkpointKeyCode != nil {
+				var err error
+				v, err = runFirst(r.checkpointKeyCode, input)
+				if err != nil {
+					return err
+				}
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			checkpointKey = string(b)
+			if ckpt.has(checkpointKey) {
+				r.logger.printf(severityDebug, "skip input[%v]: %v is in checkpoint", inputIndex, checkpointKey)
+				continue
+			}
+		}
+
+		dispatched++
+
+		// inputCtx parents the spans of all requests of this input.
+		inputCtx, inputSpan := tracer().Start(ctx, "input", trace.WithAttributes(attribute.Int("input.index", inputIndex)))
+		if r.config.RetryBudget > 0 {
+			inputCtx = withRetryBudget(inputCtx, r.config.RetryBudget)
+		}
+		atomic.AddInt64(&r.progress.inputs, 1)
+		// pending counts the goroutines of this input and the loop starting them,
+		// and the last one to finish finishes the input.
+		pending := int64(1)
+		// inputFailed is set if any url of this input failed or responded non-200.
+		var inputFailed int32
+		// lastSeq is the sequence number of the last url of this input, or of the previous one if it has no urls.
+		lastSeq := count - 1
+		finishInput := func() {
+			if atomic.AddInt64(&pending, -1) != 0 {
+				return
+			}
+			atomic.AddInt64(&r.progress.inputsDone, 1)
+			inputSpan.End()
+			if ckpt != nil && r.config.Execute && atomic.LoadInt32(&inputFailed) == 0 {
+				// after Results of the input, so that the key is recorded once they are written
+				marker := Result{checkpointKey: checkpointKey}
+				if ord != nil {
+					ord.after(ctx, lastSeq, marker)
+				} else {
+					sendResult(marker)
+				}
+			}
+		}
+
+		var body interface{}
+		if r.bodyCode != nil {
+			var err error
+			body, err = runFirst(r.bodyCode, input)
+			if err != nil {
+				return err
+			}
+		}
+
+		var inputHeaders http.Header
+		if r.headerCode != nil {
+			v, err := runFirst(r.headerCode, input)
+			if err != nil {
+				return err
+			}
+			inputHeaders, err = toHeader(v)
+			if err != nil {
+				return err
+			}
+		}
+
+		inputQuery := r.staticQuery
+		if r.queryCode != nil {
+			v, err := runFirst(r.queryCode, input)
+			if err != nil {
+				return err
+			}
+			exprQuery, err := toQuery(v)
+			if err != nil {
+				return err
+			}
+			inputQuery = mergeQuery(r.staticQuery, exprQuery)
+		}
+
+		run := runChain(r.urlCodes, input)
+		for {
+			i, ok := run.Next()
+			if !ok {
+				break
+			}
+			urlIndex := run.index
+			// urlErr fails only this url in its goroutine, like errors of requests
+			ur, urlErr := toURLRequest(i)
+			baseUrl := ur.url
+			method := r.config.Method
+			if ur.method != "" {
+				method = ur.method
+			}
+			urlBody := body
+			if ur.hasBody {
+				urlBody = ur.body
+			}
+			urlHeaders := mergeHeader(inputHeaders, ur.headers)
+			urlQuery := mergeQuery(inputQuery, ur.query)
+
+			nowCount := count
+			count++
+			lastSeq = nowCount
+			atomic.AddInt64(&r.progress.urls, 1)
+
+			collectionExpr := r.collectionExpr
+			if r.config.AutoCollection && urlErr == nil {
+				if u, err := url.Parse(baseUrl); err != nil {
+					urlErr = err
+				} else {
+					pathElems := strings.Split(u.Path, "/")
+					name := pathElems[len(pathElems)-1]
+					collectionExpr = &fieldExpr{src: name, path: []string{name}}
+				}
+			}
+
+			fields := r.config.Fields
+			if fields != "" && collectionExpr != nil {
+				collectionPath := collectionExpr.path
+				if r.config.Aggregated {
+					collectionPath = []string{"items"}
+				}
+				var nextPageTokenPath []string
+				if r.nextLinkExpr != nil {
+					nextPageTokenPath = r.nextLinkExpr.path
+				} else if r.config.Pagination == paginationPageToken {
+					nextPageTokenPath = r.nextPageTokenExpr.path
+				}
+				var totalSizePath []string
+				if r.totalSizeExpr != nil {
+					totalSizePath = r.totalSizeExpr.path
+				}
+				fields = fieldsWithPaths(fields, collectionPath, nextPageTokenPath, totalSizePath)
+			}
+
+			// Acquire semaphore before eg.Go to stabilize output order when parallelism=1
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			atomic.AddInt64(&pending, 1)
+			eg.Go(func() (err error) {
+				defer sem.Release(1)
+				defer func() {
+					if err != nil {
+						atomic.StoreInt32(&inputFailed, 1)
+					}
+					finishInput()
+				}()
+				send := sendResult
+				if ord != nil {
+					send = ord.sender(ctx, nowCount)
+					defer ord.finish(ctx, nowCount)
+				}
+				// failURL fails only this url so other inputs can proceed.
+				failURL := func(method, u string, err error) error {
+					r.logger.url(severityError, urlEvent{Event: "failed", Count: nowCount, Method: method, URL: u, Reason: err.Error()})
+					atomic.AddInt64(&failedCount, 1)
+					failedUrlsTotal.Inc()
+					atomic.StoreInt32(&inputFailed, 1)
+					return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Err: err})
+				}
+				if urlErr != nil {
+					return failURL(method, baseUrl, urlErr)
+				}
+				var nextPageToken string
+				var offset int
+				// keys of --dedupe-items-by
+				seen := make(map[string]bool)
+				pageUrl := baseUrl
+				var collection []interface{}
+				// other fields of pages, auxiliaryKeys or all with --merge-fields
+				var pageFields map[string]interface{}
+				var pageCount, itemCount int
+				var truncated bool
+				// totalSize is the number of --total-size-field in the first page if hasTotalSize
+				var totalSize int
+				var hasTotalSize bool
+				var prefetch *pagePrefetcher
+				// fields of the next page, which --deep-collection may replace on the first page
+				nextPageTokenExpr, nextLinkExpr := r.nextPageTokenExpr, r.nextLinkExpr
+				// fetchedPages also counts responses of errors and non-collections, unlike pageCount
+				var fetchedPages int
+				start := time.Now()
+				sendPage := send
+				send = func(res Result) error {
+					res.Duration = time.Since(start)
+					res.Pages = fetchedPages
+					return sendPage(res)
+				}
+				defer func() {
+					if prefetch != nil {
+						prefetch.close()
+					}
+				}()
+				// newPageRequest builds the request of a page and logs it.
+				newPageRequest := func(pageUrl string, pageBody interface{}, offset int, nextPageToken string) (*http.Request, error) {
+					var reqBody io.Reader
+					if pageBody != nil {
+						b, err := json.Marshal(pageBody)
+						if err != nil {
+							return nil, err
+						}
+						reqBody = bytes.NewReader(b)
+					}
+					req, err := http.NewRequest(method, pageUrl, reqBody)
+					if err != nil {
+						return nil, err
+					}
+					r.overrideEndpoint(req)
+					if pageBody != nil {
+						req.Header.Set("Content-Type", "application/json")
+					}
+					q := req.URL.Query()
+					if _, ok := q["fields"]; !ok && fields != "" {
+						q.Set("fields", fields)
+					}
+					for k, vs := range urlQuery {
+						if _, ok := q[k]; !ok {
+							q[k] = vs
+						}
+					}
+					pageSizeParam := r.config.PageSizeParam
+					if r.config.Pagination == paginationOffset {
+						pageSizeParam = r.config.LimitParam
+					}
+					if _, ok := q[pageSizeParam]; !ok && r.config.PageSize > 0 {
+						q.Set(pageSizeParam, strconv.Itoa(r.config.PageSize))
+					}
+					if offset > 0 {
+						q.Set(r.config.OffsetParam, strconv.Itoa(offset))
+					}
+					if nextPageToken != "" && !r.config.PageTokenInBody {
+						q.Add(r.config.PageTokenParam, nextPageToken)
+					}
+					req.URL.RawQuery = q.Encode()
+					if r.config.BillingProject != "" {
+						req.Header.Add(r.config.QuotaHeaderName, r.config.BillingProject)
+					}
+					for k, vs := range r.headers {
+						for _, v := range vs {
+							req.Header.Add(k, v)
+						}
+					}
+					for k, vs := range urlHeaders {
+						req.Header[k] = vs
+					}
+					if r.config.UserAgent != "" {
+						req.Header.Set("User-Agent", r.userAgent(req.Header.Get("User-Agent")))
+					}
+					// requests are the output of dry-run
+					severity := severityDebug
+					if !r.config.Execute && !r.config.DryRunOutput {
+						severity = severityInfo
+					}
+					r.muStderr.Lock()
+					r.logger.url(severity, urlEvent{Event: "do", Count: nowCount, Method: req.Method, URL: req.URL.String()})
+					r.muStderr.Unlock()
+					return req, nil
+				}
+				// fetchPage sends req, revalidating the cached response by ETag.
+				fetchPage := func(ctx context.Context, req *http.Request) (*http.Response, *cacheEntry, error) {
+					var cached *cacheEntry
+					if cache != nil && req.Method == http.MethodGet {
+						if e, ok := cache.get(req.URL.String()); ok {
+							cached = &e
+							req.Header.Set("If-None-Match", e.ETag)
+						}
+					}
+					if dedupe != nil {
+						resp, err := dedupe.do(req, func() (*http.Response, error) {
+							return r.do(ctx, req, nowCount)
+						})
+						return resp, cached, err
+					}
+					resp, err := r.do(ctx, req, nowCount)
+					return resp, cached, err
+				}
+				for {
+					var req *http.Request
+					var resp *http.Response
+					var cached *cacheEntry
+					if p, ok := prefetch.get(offset); ok {
+						req, resp, cached, err = p.req, p.resp, p.cached, p.err
+					} else {
+						pageBody := urlBody
+						if r.config.PageTokenInBody && nextPageToken != "" {
+							b, err := withPageToken(urlBody, r.config.PageTokenBodyKey, nextPageToken)
+							if err != nil {
+								return failURL(method, pageUrl, err)
+							}
+							pageBody = b
+						}
+						req, err = newPageRequest(pageUrl, pageBody, offset, nextPageToken)
+						if err != nil {
+							return failURL(method, pageUrl, err)
+						}
+						if r.config.DryRunOutput {
+							return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Request: req})
+						}
+						if !r.config.Execute {
+							return nil
+						}
+						resp, cached, err = fetchPage(inputCtx, req)
+					}
+					if err != nil && req == nil {
+						// the request of a prefetched page couldn't be built
+						return failURL(method, pageUrl, err)
+					} else if err != nil {
+						return failURL(req.Method, req.URL.String(), err)
+					}
+					fetchedPages++
+
+					body, err := func() ([]byte, error) {
+						defer resp.Body.Close()
+						return io.ReadAll(resp.Body)
+					}()
+					if err != nil {
+						return failURL(req.Method, req.URL.String(), err)
+					}
+					if cached != nil && resp.StatusCode == http.StatusNotModified {
+						body = cached.body()
+						resp.StatusCode, resp.Status = http.StatusOK, "200 OK"
+					} else if etag := resp.Header.Get("ETag"); cache != nil && req.Method == http.MethodGet && resp.StatusCode == http.StatusOK && etag != "" {
+						cache.put(req.URL.String(), etag, body)
+					}
+
+					if r.downloadCode != nil && resp.StatusCode == http.StatusOK {
+						path, err := r.download(input, body)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Response: map[string]interface{}{"file": path, "size": len(body)}, Status: resp.StatusCode})
+					}
+
+					var arrayKeys map[string]bool
+					if collectionExpr != nil {
+						arrayKeys = map[string]bool{collectionExpr.topKey(): true}
+					}
+					v, err := r.decodeBody(resp, body, arrayKeys)
+					if err != nil {
+						return fmt.Errorf("invalid response of %v: %w", req.URL, err)
+					}
+
+					if resp.StatusCode != http.StatusOK {
+						errorResponsesTotal.WithLabelValues(statusLabel(resp.StatusCode)).Inc()
+						if r.config.FailOnError {
+							atomic.AddInt64(&failedCount, 1)
+						}
+						atomic.StoreInt32(&inputFailed, 1)
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Response: v, Status: resp.StatusCode, Err: errors.New(resp.Status)})
+					}
+					i, ok := v.(map[string]interface{})
+					if !ok && collectionExpr == nil && !r.config.WaitOperation {
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Response: v, Status: resp.StatusCode})
+					} else if !ok {
+						return failURL(req.Method, req.URL.String(), fmt.Errorf("response is not a JSON object: %.100s", body))
+					}
+					if collectionExpr == nil && r.config.WaitOperation {
+						op, err := r.waitOperation(inputCtx, req, i, nowCount)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Response: op, Status: http.StatusOK})
+					}
+					if collectionExpr == nil {
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Response: i, Status: resp.StatusCode})
+					}
+
+					if r.config.AutoCollection && !r.config.Aggregated && pageCount == 0 {
+						var tokenPath []string
+						if r.config.DeepCollection {
+							collectionExpr, tokenPath, err = inferDeepCollection(i, collectionExpr, r.nextPageTokenKey())
+						} else {
+							collectionExpr, err = inferCollection(i, collectionExpr)
+						}
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+						// page by the token next to the collection, instead of one at the configured path
+						if tokenPath != nil {
+							tokenExpr := &fieldExpr{src: strings.Join(tokenPath, "."), path: tokenPath}
+							if nextLinkExpr != nil {
+								nextLinkExpr = tokenExpr
+							} else {
+								nextPageTokenExpr = tokenExpr
+							}
+						}
+						if r.config.DeepCollection {
+							r.logger.printf(severityDebug, "url[%v]: deep collection is %v, next page is %v", nowCount, collectionExpr.src, r.nextPageSrc(nextPageTokenExpr, nextLinkExpr))
+						}
+					}
+					if r.totalSizeExpr != nil && pageCount == 0 {
+						n, ok, err := r.totalSizeExpr.int(i)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+						if ok && r.config.Count {
+							return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Count: n, Status: resp.StatusCode})
+						}
+						totalSize, hasTotalSize = n, ok
+					}
+
+					var items []interface{}
+					if r.config.Aggregated {
+						items, err = aggregatedItems(i, collectionExpr, r.config.AggregatedScopeField)
+					} else {
+						items, err = collectionExpr.items(i)
+					}
+					if err != nil {
+						return failURL(req.Method, req.URL.String(), err)
+					}
+					pageItemCount := len(items)
+					if r.dedupeItemsCode != nil {
+						items, err = dedupeItems(r.dedupeItemsCode, items, seen)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+					}
+					if r.selectCode != nil {
+						items, err = selectItems(r.selectCode, items)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+					}
+					if r.mapCode != nil {
+						items, err = mapItems(r.mapCode, items)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+					}
+					pagingKeys := r.pagingKeys(collectionExpr, nextPageTokenExpr, nextLinkExpr)
+					keepField := func(k string) bool {
+						return !pagingKeys[k] && (r.config.MergeFields || auxiliaryKeys[k])
+					}
+					if !r.config.Stream {
+						pageFields = mergeFields(pageFields, i, keepField)
+					}
+					itemsTotal.Add(float64(len(items)))
+					pageCount++
+					// npt is the next URL with --pagination=link-header or --next-link-field, and the next offset with --pagination=offset
+					var npt string
+					switch {
+					case r.config.Pagination == paginationLinkHeader:
+						npt, err = nextLink(resp.Header, resp.Request.URL)
+					case nextLinkExpr != nil:
+						npt, err = nextLinkExpr.string(i)
+						if err == nil && npt != "" {
+							npt, err = resolveURL(resp.Request.URL, npt)
+						}
+					case r.config.Pagination == paginationOffset:
+						if pageItemCount > 0 && pageItemCount >= r.config.PageSize {
+							npt = strconv.Itoa(offset + pageItemCount)
+						}
+					default:
+						npt, err = nextPageTokenExpr.string(i)
+					}
+					if err != nil {
+						return failURL(req.Method, req.URL.String(), err)
+					}
+					if r.config.MaxItems > 0 && itemCount+len(items) >= r.config.MaxItems {
+						truncated = npt != "" || itemCount+len(items) > r.config.MaxItems
+						items = items[:r.config.MaxItems-itemCount]
+						npt = ""
+					} else if npt != "" && r.config.MaxPages > 0 && pageCount >= r.config.MaxPages {
+						truncated = true
+						npt = ""
+					}
+					itemCount += len(items)
+					if npt != "" && hasTotalSize && prefetch == nil && r.config.PageParallelism > 1 {
+						end := totalSize
+						if r.config.MaxItems > 0 && r.config.MaxItems < end {
+							end = r.config.MaxItems
+						}
+						var n int
+						if r.config.MaxPages > 0 {
+							n = r.config.MaxPages - pageCount
+						}
+						prefetch = prefetchPages(inputCtx, pageOffsets(offset+pageItemCount, end, r.config.PageSize, n), r.config.PageParallelism, func(ctx context.Context, offset int) pageResponse {
+							req, err := newPageRequest(baseUrl, urlBody, offset, "")
+							if err != nil {
+								return pageResponse{err: err}
+							}
+							resp, cached, err := fetchPage(ctx, req)
+							return pageResponse{req: req, resp: resp, cached: cached, err: err}
+						})
+					}
+
+					if r.config.Flatten {
+						for _, item := range items {
+							if err := send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Item: item, Status: resp.StatusCode}); err != nil {
+								return err
+							}
+						}
+					} else if r.config.Stream {
+						if err := send(Result{
+							Input:     input,
+							URL:       baseUrl,
+							Index:     nowCount,
+							UrlIndex:  urlIndex,
+							Response:  withFields(collectionResponse(collectionExpr, items), mergeFields(nil, i, keepField)),
+							Status:    resp.StatusCode,
+							Truncated: truncated,
+						}); err != nil {
+							return err
+						}
+					} else if !r.config.Count {
+						collection = append(collection, items...)
+					}
+
+					if npt != "" {
+						switch {
+						case r.config.Pagination == paginationLinkHeader || r.nextLinkExpr != nil:
+							pageUrl = npt
+						case r.config.Pagination == paginationOffset:
+							offset += pageItemCount
+						default:
+							nextPageToken = npt
+						}
+						continue
+					}
+					if r.config.Flatten || r.config.Stream {
+						return nil
+					}
+					if r.config.Count {
+						return send(Result{Input: input, URL: baseUrl, Index: nowCount, UrlIndex: urlIndex, Count: itemCount, Status: resp.StatusCode, Truncated: truncated})
+					}
+					var then []ThenResult
+					if r.thenUrlCode != nil {
+						then, err = r.then(inputCtx, req, collection, nowCount)
+						if err != nil {
+							return failURL(req.Method, req.URL.String(), err)
+						}
+					}
+					return send(Result{
+						Input:     input,
+						URL:       baseUrl,
+						Index:     nowCount,
+						UrlIndex:  urlIndex,
+						Response:  withFields(collectionResponse(collectionExpr, collection), pageFields),
+						Status:    resp.StatusCode,
+						Truncated: truncated,
+						Then:      then,
+					})
+				}
+			})
+		}
+		finishInput()
+	}
+	err := eg.Wait()
+	// flush before the deferred cancel
+	if ord != nil {
+		ord.close()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %v: %w", r.config.Timeout, ctx.Err())
+	}
+	if err != nil {
+		return err
+	}
+	if failedCount > 0 {
+		return &FailedError{Failed: int(failedCount), Total: count}
+	}
+	return nil
+}
+
+// FailedError is the error of a run in which some urls failed without response,
+// or with non-200 responses if FailOnError.
+type FailedError struct {
+	Failed int
+	Total  int
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("%v of %v urls failed", e.Failed, e.Total)
+}
+
+// pagingKeys are the top-level keys of the collection and the next page in responses, excluded from other fields.
+func (r *Runner) pagingKeys(collectionExpr, nextPageTokenExpr, nextLinkExpr *fieldExpr) map[string]bool {
+	keys := map[string]bool{collectionExpr.topKey(): true}
+	if r.config.Aggregated {
+		keys["items"] = true
+	}
+	if nextLinkExpr != nil {
+		keys[nextLinkExpr.topKey()] = true
+	} else if r.config.Pagination == paginationPageToken {
+		keys[nextPageTokenExpr.topKey()] = true
+	}
+	return keys
+}
+
+// nextPageTokenKey is the key of the next page in the object next to the collection, searched by --deep-collection.
+func (r *Runner) nextPageTokenKey() string {
+	expr := r.nextPageTokenExpr
+	if r.nextLinkExpr != nil {
+		expr = r.nextLinkExpr
+	}
+	if expr.path == nil {
+		return "nextPageToken"
+	}
+	return expr.path[len(expr.path)-1]
+}
+
+// nextPageSrc describes where the next page comes from for logs.
+func (r *Runner) nextPageSrc(nextPageTokenExpr, nextLinkExpr *fieldExpr) string {
+	switch {
+	case r.config.Pagination == paginationLinkHeader:
+		return "Link header"
+	case nextLinkExpr != nil:
+		return nextLinkExpr.src
+	case r.config.Pagination == paginationOffset:
+		return "offset"
+	default:
+		return nextPageTokenExpr.src
+	}
+}
+
+// decodeBody decodes body of resp by --xml or as JSON, or into {rawBody, contentType} if it can't be decoded,
+// e.g. 204, HTML pages of proxies and gateways, and broken bodies. It fails on them instead with --strict-json.
+func (r *Runner) decodeBody(resp *http.Response, body []byte, arrayKeys map[string]bool) (interface{}, error) {
+	var v interface{}
+	var err error
+	if r.config.Xml {
+		v, err = decodeXML(body, arrayKeys)
+	} else {
+		err = json.Unmarshal(body, &v)
+	}
+	if err != nil && r.config.StrictJSON {
+		return nil, err
+	} else if err != nil {
+		return rawResponse(resp, body), nil
+	}
+	return v, nil
+}
+
+// download writes body into the file of --download for input, and returns the path.
+func (r *Runner) download(input interface{}, body []byte) (string, error) {
+	v, err := runFirst(r.downloadCode, input)
+	if err != nil {
+		return "", err
+	}
+	path, ok := v.(string)
+	if !ok || path == "" {
+		return "", fmt.Errorf("download file path must be a non-empty string: %v", v)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, body, 0644)
+}
+
+// userAgent returns the User-Agent header of --user-agent for a request of the User-Agent ua.
+func (r *Runner) userAgent(ua string) string {
+	if !r.config.AppendUserAgent {
+		return r.config.UserAgent
+	}
+	if ua == "" {
+		// the default of net/http, which isn't sent if User-Agent is set
+		ua = "Go-http-client/1.1"
+	}
+	return ua + " " + r.config.UserAgent
+}
+
+// do sends req under the rate limiter, and retries it by the backoff policy on timeouts and retryable responses.
+// index is the sequence number of the URL in logs.
+func (r *Runner) do(ctx context.Context, req *http.Request, index int) (resp *http.Response, err error) {
+	ctx, span := tracer().Start(ctx, "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.method", req.Method),
+		attribute.String("http.url", req.URL.String()),
+		attribute.Int("url.index", index),
+	))
+	var attempt int
+	defer func() {
+		span.SetAttributes(attribute.Int("http.attempt", attempt))
+		switch {
+		case err != nil:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		case resp != nil:
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			if resp.StatusCode >= http.StatusBadRequest {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+		}
+		span.End()
+	}()
+
+	// set explicitly to be dumped, so the transport leaves decoding to decodeContent
+	if !r.config.NoCompression && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	// stop the timer goroutine of the controller on return, which otherwise lives until ctx is done
+	backoffCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	backoffCtl := r.backoffPolicy.Start(backoffCtx)
+	var lastReason string
+	var refreshed bool
+	for backoff.Continue(backoffCtl) {
+		// Continue may choose the next attempt over cancellation
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if r.breaker != nil {
+			if err := r.breaker.allow(req.URL.Host, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		attempt++
+		resp, err := func() (*http.Response, error) {
+			// rewind body consumed by previous attempt
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+			var buf bytes.Buffer
+			if r.config.LogHttp {
+				defer func() {
+					r.muStderr.Lock()
+					defer r.muStderr.Unlock()
+					io.Copy(os.Stderr, &buf)
+				}()
+				b, _ := httputil.DumpRequest(req, true)
+				buf.Write(b)
+			}
+
+			reqCtx, cancel := ctx, context.CancelFunc(func() {})
+			if r.config.RequestTimeout > 0 {
+				reqCtx, cancel = context.WithTimeout(ctx, r.config.RequestTimeout)
+			}
+			defer cancel()
+
+			rl := r.rl
+			if r.hostRl != nil {
+				rl = r.hostRl.get(req.URL.Host)
+			}
+			if err := take(ctx, rl); err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			var status int
+			defer func() {
+				requestDuration.Observe(time.Since(start).Seconds())
+				requestsTotal.WithLabelValues(statusLabel(status)).Inc()
+			}()
+			atomic.AddInt64(&r.progress.requests, 1)
+			resp, err := r.client.Do(req.WithContext(reqCtx))
+			if err != nil {
+				return nil, err
+			}
+			// read the body before cancel
+			b, err := func() ([]byte, error) {
+				defer resp.Body.Close()
+				return readLimited(resp.Body, r.config.MaxResponseSize)
+			}()
+			if err != nil {
+				return nil, err
+			}
+			status = resp.StatusCode
+			b, err = decodeContent(resp, b, r.config.MaxResponseSize)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(b))
+			if l, ok := rl.(feedbackLimiter); ok {
+				_, rateLimited := rateLimitExceeded(resp)
+				l.observe(resp.StatusCode == http.StatusTooManyRequests || rateLimited)
+			}
+			if r.config.LogHttp {
+				b, _ := httputil.DumpResponse(resp, true)
+				buf.Write(b)
+			}
+			return resp, nil
+		}()
+
+		if r.breaker != nil {
+			// only failures of the host count, e.g. not 404 of a missing resource nor cancellation
+			failed := err != nil && ctx.Err() == nil || resp != nil && (resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests)
+			if r.breaker.observe(req.URL.Host, failed, time.Now()) {
+				r.logger.printf(severityWarning, "open circuit of %v for %v after %v consecutive failures", req.URL.Host, r.config.CircuitBreakerCooldown, r.config.CircuitBreakerThreshold)
+			}
+		}
+		var tooLarge *responseTooLargeError
+		if err != nil && ctx.Err() == nil && (isTimeout(err) || r.config.RetryOversizedResponse && errors.As(err, &tooLarge)) {
+			if err := r.noteRetry(ctx, span, index, req, 0, attempt, err.Error()); err != nil {
+				return nil, err
+			}
+			lastReason = err.Error()
+			continue
+		} else if err != nil {
+			return resp, err
+		} else if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified && req.Header.Get("If-None-Match") != "" {
+			return resp, nil
+		} else if resp.StatusCode == http.StatusUnauthorized && r.tokens != nil && !refreshed {
+			// the token may be expired or revoked in the middle of a long run
+			reason := "refresh token after " + resp.Status
+			if err := r.noteRetry(ctx, span, index, resp.Request, resp.StatusCode, attempt, reason); err != nil {
+				discardBody(resp)
+				return nil, err
+			}
+			lastReason = reason
+			discardBody(resp)
+			r.tokens.invalidate(resp.Request.Header.Get("Authorization"))
+			refreshed = true
+			continue
+		} else if reason, ok := retryReason(resp); ok {
+			if err := r.noteRetry(ctx, span, index, resp.Request, resp.StatusCode, attempt, reason); err != nil {
+				discardBody(resp)
+				return nil, err
+			}
+			lastReason = reason
+			discardBody(resp)
+			if d, ok := retryAfter(resp.Header, time.Now()); ok {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			continue
+		} else {
+			r.logger.url(severityError, urlEvent{Event: "error", Count: index, Method: resp.Request.Method, URL: resp.Request.URL.String(), Status: resp.StatusCode, Attempt: attempt, Reason: resp.Status})
+			return resp, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("backoff finally failed, last reason: %v", lastReason)
+}
+
+// noteRetry logs and counts a retry of req of the url index, with the status of the response or 0 without a response.
+// It returns an error instead if the retry budget of the input in ctx is spent.
+func (r *Runner) noteRetry(ctx context.Context, span trace.Span, index int, req *http.Request, status, attempt int, reason string) error {
+	if !takeRetry(ctx) {
+		return fmt.Errorf("retry budget of the input is spent, last reason: %v", reason)
+	}
+	r.logger.url(severityWarning, urlEvent{Event: "retry", Count: index, Method: req.Method, URL: req.URL.String(), Status: status, Attempt: attempt, Reason: reason})
+	attrs := []attribute.KeyValue{attribute.Int("http.attempt", attempt)}
+	if status != 0 {
+		attrs = append(attrs, attribute.Int("http.status_code", status))
+	}
+	span.AddEvent("retry", trace.WithAttributes(append(attrs, attribute.String("reason", reason))...))
+	retriesTotal.Inc()
+	atomic.AddInt64(&r.progress.retries, 1)
+	return nil
+}
+
+// overrideEndpoint replaces the host of req by --endpoint-override.
+func (r *Runner) overrideEndpoint(req *http.Request) {
+	if r.config.EndpointOverride == "" {
+		return
+	}
+	req.URL.Host = r.config.EndpointOverride
+	req.URL.Scheme = "https"
+	if r.config.Plaintext {
+		req.URL.Scheme = "http"
+	}
+	req.Host = req.URL.Host
+}
+
+// operationDone reports whether op is done as a google.longrunning.Operation or a Compute Engine operation.
+func operationDone(op map[string]interface{}) bool {
+	return op["done"] == true || op["status"] == "DONE"
+}
+
+// operationURL returns the URL to poll op, which is created by req.
+func (r *Runner) operationURL(req *http.Request, op map[string]interface{}) (string, error) {
+	if r.operationUrlCode != nil {
+		v, err := runFirst(r.operationUrlCode, op)
+		if err != nil {
+			return "", err
+		}
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return "", fmt.Errorf("operation URL must be a non-empty string: %v", v)
+		}
+		return resolveURL(req.URL, s)
+	}
+	if selfLink, ok := op["selfLink"].(string); ok && selfLink != "" {
+		return selfLink, nil
+	}
+	name, ok := op["name"].(string)
+	if !ok || name == "" {
+		return "", fmt.Errorf("operation has neither selfLink nor name: %v", op)
+	}
+	version := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+	return resolveURL(req.URL, "/"+version+"/"+name)
+}
+
+// waitOperation polls op created by req at intervals of the backoff policy until it is done, and returns the final operation.
+func (r *Runner) waitOperation(ctx context.Context, req *http.Request, op map[string]interface{}, index int) (map[string]interface{}, error) {
+	// polls are spaced by --backoff-strategy without the limit of retries, bounded by --timeout instead
+	pollConfig := r.config
+	pollConfig.MaxRetries = 0
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pollCtl := newBackoffPolicy(pollConfig).Start(pollCtx)
+	var polls int
+	for !operationDone(op) {
+		u, err := r.operationURL(req, op)
+		if err != nil {
+			return nil, err
+		}
+		if !backoff.Continue(pollCtl) || ctx.Err() != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("operation not done after %v polls", polls)
+		}
+		polls++
+		pollReq, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		pollReq.Header = req.Header.Clone()
+		pollReq.Header.Del("Content-Type")
+		r.overrideEndpoint(pollReq)
+		r.muStderr.Lock()
+		r.logger.url(severityDebug, urlEvent{Event: "poll", Count: index, Method: pollReq.Method, URL: pollReq.URL.String()})
+		r.muStderr.Unlock()
+		resp, err := r.do(ctx, pollReq, index)
+		if err != nil {
+			return nil, err
+		}
+		body, err := func() ([]byte, error) {
+			defer resp.Body.Close()
+			return io.ReadAll(resp.Body)
+		}()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to poll operation %v: %v", u, resp.Status)
+		}
+		op = nil
+		if err := json.Unmarshal(body, &op); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
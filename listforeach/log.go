@@ -0,0 +1,105 @@
+package listforeach
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// severities of Cloud Logging
+const (
+	severityDebug   = "DEBUG"
+	severityInfo    = "INFO"
+	severityWarning = "WARNING"
+	severityError   = "ERROR"
+)
+
+// severityOfLevel maps --log-level to the lowest severity to be logged.
+var severityOfLevel = map[string]string{
+	"debug": severityDebug,
+	"info":  severityInfo,
+	"warn":  severityWarning,
+	"error": severityError,
+}
+
+var severityRank = map[string]int{
+	severityDebug:   0,
+	severityInfo:    1,
+	severityWarning: 2,
+	severityError:   3,
+}
+
+// logger writes into the output of the standard logger, as text or JSON lines of Cloud Logging structured logging.
+type logger struct {
+	json    bool
+	minRank int
+}
+
+func newLogger(format, level string) *logger {
+	return &logger{json: format == logFormatJSON, minRank: severityRank[severityOfLevel[level]]}
+}
+
+func (l *logger) enabled(severity string) bool {
+	return severityRank[severity] >= l.minRank
+}
+
+// urlEvent is a log entry about a request of the URL at Count in the sequence.
+type urlEvent struct {
+	Event   string `json:"event"`
+	Count   int    `json:"count"`
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+	Status  int    `json:"status,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (e *urlEvent) String() string {
+	s := fmt.Sprintf("%v url[%v]: %v %v", e.Event, e.Count, e.Method, e.URL)
+	if e.Reason != "" {
+		s += ", reason: " + e.Reason
+	}
+	return s
+}
+
+type logEntry struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	*urlEvent
+}
+
+func (l *logger) printf(severity, format string, args ...interface{}) {
+	l.print(logEntry{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// alwaysf logs regardless of --log-level, for warnings which must not be missed like --insecure-skip-tls-verify.
+func (l *logger) alwaysf(severity, format string, args ...interface{}) {
+	l.write(logEntry{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *logger) url(severity string, e urlEvent) {
+	l.print(logEntry{Severity: severity, Message: e.String(), urlEvent: &e})
+}
+
+func (l *logger) print(e logEntry) {
+	if !l.enabled(e.Severity) {
+		return
+	}
+	l.write(e)
+}
+
+func (l *logger) write(e logEntry) {
+	if !l.json {
+		log.Print(e.Message)
+		return
+	}
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Print(e.Message)
+		return
+	}
+	log.Writer().Write(append(b, '\n'))
+}
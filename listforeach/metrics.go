@@ -0,0 +1,45 @@
+package listforeach
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered to prometheus.DefaultRegisterer, which the command serves on --metrics-addr.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcplistforeach_requests_total",
+		Help: "Number of requests including retries by status code, or error for failures without response.",
+	}, []string{"code"})
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gcplistforeach_retries_total",
+		Help: "Number of retried requests.",
+	})
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gcplistforeach_request_duration_seconds",
+		Help:    "Latency of each request including reading the body.",
+		Buckets: prometheus.DefBuckets,
+	})
+	errorResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcplistforeach_error_responses_total",
+		Help: "Number of non-200 responses after retries by status code.",
+	}, []string{"code"})
+	failedUrlsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gcplistforeach_failed_urls_total",
+		Help: "Number of URLs failed without response.",
+	})
+	itemsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gcplistforeach_items_total",
+		Help: "Number of collected collection items after --select and --map.",
+	})
+)
+
+// statusLabel is the code label of status, or error if no response.
+func statusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
@@ -0,0 +1,113 @@
+package listforeach
+
+import (
+	"context"
+	"sync"
+)
+
+// reorderer forwards Results in the order of the sequence numbers of urls for --ordered,
+// buffering Results of later urls until all earlier urls finish.
+type reorderer struct {
+	ch        chan orderedResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type orderedResult struct {
+	seq      int
+	res      Result
+	finished bool
+	// after is forwarded once all urls up to seq finish, like the checkpoint key of an input
+	after bool
+}
+
+// newReorderer forwards Results into results until ctx is done.
+func newReorderer(ctx context.Context, results chan<- Result) *reorderer {
+	o := &reorderer{ch: make(chan orderedResult), done: make(chan struct{})}
+	go o.run(ctx, results)
+	return o
+}
+
+func (o *reorderer) run(ctx context.Context, results chan<- Result) {
+	defer close(o.done)
+	var next int
+	buffered := make(map[int][]Result)
+	finished := make(map[int]bool)
+	afters := make(map[int][]Result)
+	// stop forwarding after ctx is done, but keep receiving so that senders don't block
+	forward := func(res Result) {
+		select {
+		case results <- res:
+		case <-ctx.Done():
+		}
+	}
+	// advance moves next past the finished url
+	advance := func() {
+		for _, res := range afters[next] {
+			forward(res)
+		}
+		delete(afters, next)
+		next++
+	}
+	for r := range o.ch {
+		switch {
+		case r.after && r.seq < next:
+			forward(r.res)
+		case r.after:
+			afters[r.seq] = append(afters[r.seq], r.res)
+		case r.seq != next && r.finished:
+			finished[r.seq] = true
+		case r.seq != next:
+			buffered[r.seq] = append(buffered[r.seq], r.res)
+		case !r.finished:
+			forward(r.res)
+		default:
+			advance()
+			for {
+				for _, res := range buffered[next] {
+					forward(res)
+				}
+				delete(buffered, next)
+				if !finished[next] {
+					break
+				}
+				delete(finished, next)
+				advance()
+			}
+		}
+	}
+}
+
+// sender returns the function to send Results of the url of seq.
+func (o *reorderer) sender(ctx context.Context, seq int) func(Result) error {
+	return func(res Result) error {
+		return o.send(ctx, orderedResult{seq: seq, res: res})
+	}
+}
+
+// finish marks the url of seq finished, which must be called after all Results of it are sent.
+func (o *reorderer) finish(ctx context.Context, seq int) {
+	o.send(ctx, orderedResult{seq: seq, finished: true})
+}
+
+// after sends res after all Results of urls up to seq, which may have already finished.
+func (o *reorderer) after(ctx context.Context, seq int, res Result) {
+	o.send(ctx, orderedResult{seq: seq, res: res, after: true})
+}
+
+func (o *reorderer) send(ctx context.Context, r orderedResult) error {
+	select {
+	case o.ch <- r:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close waits for the remaining Results of finished urls to be forwarded. It can be called more than once.
+func (o *reorderer) close() {
+	o.closeOnce.Do(func() {
+		close(o.ch)
+	})
+	<-o.done
+}
@@ -0,0 +1,98 @@
+package listforeach
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// pageResponse is the response of a page fetched ahead by pagePrefetcher.
+type pageResponse struct {
+	req    *http.Request
+	resp   *http.Response
+	cached *cacheEntry
+	err    error
+}
+
+// pagePrefetcher fetches pages of known offsets concurrently for --page-parallelism,
+// while the paging loop consumes them in order of offsets.
+type pagePrefetcher struct {
+	cancel context.CancelFunc
+	sem    *semaphore.Weighted
+	pages  map[int]chan pageResponse
+	wg     sync.WaitGroup
+}
+
+// prefetchPages starts fetching pages of offsets in order by fetch.
+// Up to parallelism pages are in flight or waiting for get at once.
+func prefetchPages(ctx context.Context, offsets []int, parallelism int, fetch func(ctx context.Context, offset int) pageResponse) *pagePrefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pagePrefetcher{
+		cancel: cancel,
+		sem:    semaphore.NewWeighted(int64(parallelism)),
+		pages:  make(map[int]chan pageResponse, len(offsets)),
+	}
+	// pages is only for get, which deletes consumed pages
+	chs := make([]chan pageResponse, len(offsets))
+	for i, offset := range offsets {
+		chs[i] = make(chan pageResponse, 1)
+		p.pages[offset] = chs[i]
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for i, offset := range offsets {
+			if err := p.sem.Acquire(ctx, 1); err != nil {
+				// get falls back to the paging loop
+				for _, ch := range chs[i:] {
+					close(ch)
+				}
+				return
+			}
+			ch := chs[i]
+			offset := offset
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				ch <- fetch(ctx, offset)
+			}()
+		}
+	}()
+	return p
+}
+
+// get waits for the page of offset. It returns false if the page isn't fetched ahead.
+func (p *pagePrefetcher) get(offset int) (pageResponse, bool) {
+	if p == nil {
+		return pageResponse{}, false
+	}
+	ch, ok := p.pages[offset]
+	if !ok {
+		return pageResponse{}, false
+	}
+	delete(p.pages, offset)
+	pr, ok := <-ch
+	if !ok {
+		return pageResponse{}, false
+	}
+	p.sem.Release(1)
+	return pr, true
+}
+
+// close cancels pages not consumed yet, e.g. after a short page or --max-items.
+func (p *pagePrefetcher) close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// pageOffsets returns offsets of full pages of size from start to before end.
+// At most n offsets are returned if n > 0.
+func pageOffsets(start, end, size, n int) []int {
+	var offsets []int
+	for o := start; o < end && (n <= 0 || len(offsets) < n); o += size {
+		offsets = append(offsets, o)
+	}
+	return offsets
+}
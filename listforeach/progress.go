@@ -0,0 +1,47 @@
+package listforeach
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// progress counts the work of a Runner since New for --progress. Fields are accessed atomically.
+type progress struct {
+	inputs     int64
+	inputsDone int64
+	urls       int64
+	requests   int64
+	retries    int64
+}
+
+func (p *progress) String() string {
+	inputs, done := atomic.LoadInt64(&p.inputs), atomic.LoadInt64(&p.inputsDone)
+	return fmt.Sprintf("inputs: %v done, %v in flight, urls: %v, requests: %v, retries: %v",
+		done, inputs-done, atomic.LoadInt64(&p.urls), atomic.LoadInt64(&p.requests), atomic.LoadInt64(&p.retries))
+}
+
+// reportProgress logs the progress every --progress-interval until the returned function is called,
+// which logs the final summary.
+func (r *Runner) reportProgress() func() {
+	ticker := time.NewTicker(r.config.ProgressInterval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				r.logger.printf(severityInfo, "progress: %v", r.progress)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+		r.logger.printf(severityInfo, "finished: %v", r.progress)
+	}
+}
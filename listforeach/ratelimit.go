@@ -0,0 +1,97 @@
+package listforeach
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/ratelimit"
+)
+
+// hostLimiter keeps a limiter created by newLimiter for each host.
+type hostLimiter struct {
+	newLimiter func() ratelimit.Limiter
+
+	mu       sync.Mutex
+	limiters map[string]ratelimit.Limiter
+}
+
+func newHostLimiter(newLimiter func() ratelimit.Limiter) *hostLimiter {
+	return &hostLimiter{newLimiter: newLimiter, limiters: make(map[string]ratelimit.Limiter)}
+}
+
+func (l *hostLimiter) get(host string) ratelimit.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.limiters[host]
+	if !ok {
+		rl = l.newLimiter()
+		l.limiters[host] = rl
+	}
+	return rl
+}
+
+// take waits for rl like rl.Take, but returns the error of ctx on cancellation.
+// The abandoned Take still consumes its slot of the rate in background.
+func take(ctx context.Context, rl ratelimit.Limiter) error {
+	done := make(chan struct{})
+	go func() {
+		rl.Take()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// feedbackLimiter is a ratelimit.Limiter which adjusts its rate by responses.
+type feedbackLimiter interface {
+	ratelimit.Limiter
+	observe(throttled bool)
+}
+
+// adaptiveLimiter starts at the max rate, halves the rate on throttled responses
+// and increases it by 1% of the max rate on other responses (AIMD).
+type adaptiveLimiter struct {
+	max, min float64 // per minute
+
+	mu   sync.Mutex
+	rate float64 // per minute
+	last time.Time
+}
+
+func newAdaptiveLimiter(ratePerMinute int) *adaptiveLimiter {
+	max := float64(ratePerMinute)
+	return &adaptiveLimiter{max: max, min: math.Min(1, max), rate: max}
+}
+
+// Take reserves the next slot under the lock and sleeps without it,
+// so observe of other workers and later halving aren't blocked by the sleep.
+func (l *adaptiveLimiter) Take() time.Time {
+	l.mu.Lock()
+	now := time.Now()
+	next := l.last.Add(time.Duration(float64(time.Minute) / l.rate))
+	if next.Before(now) {
+		next = now
+	}
+	l.last = next
+	l.mu.Unlock()
+	if d := next.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+	return next
+}
+
+func (l *adaptiveLimiter) observe(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if throttled {
+		l.rate = math.Max(l.rate/2, l.min)
+	} else {
+		l.rate = math.Min(l.rate+l.max/100, l.max)
+	}
+}
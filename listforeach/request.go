@@ -0,0 +1,285 @@
+package listforeach
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// withPageToken returns a shallow copy of body with pageToken set under key.
+func withPageToken(body interface{}, key, pageToken string) (interface{}, error) {
+	if body == nil {
+		return map[string]interface{}{key: pageToken}, nil
+	}
+	m, ok := body.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("body must be an object to set %v: %v", key, body)
+	}
+	merged := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		merged[k] = v
+	}
+	merged[key] = pageToken
+	return merged, nil
+}
+
+// parseHeaders parses "Key: Value" strings with environment variables expanded in values.
+func parseHeaders(ss []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, s := range ss {
+		i := strings.Index(s, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header, must be \"Key: Value\": %v", s)
+		}
+		h.Add(strings.TrimSpace(s[:i]), os.ExpandEnv(strings.TrimSpace(s[i+1:])))
+	}
+	return h, nil
+}
+
+// toHeader converts a result of --header-expr to http.Header. null values are ignored.
+func toHeader(v interface{}) (http.Header, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("headers must be an object: %v", v)
+	}
+	h := make(http.Header, len(m))
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			h.Set(k, v)
+		default:
+			return nil, fmt.Errorf("header value must be a string: %v: %v", k, v)
+		}
+	}
+	return h, nil
+}
+
+// parseQueries parses "key=value" strings.
+func parseQueries(ss []string) (url.Values, error) {
+	q := make(url.Values)
+	for _, s := range ss {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid query, must be key=value: %v", s)
+		}
+		q.Add(s[:i], s[i+1:])
+	}
+	return q, nil
+}
+
+// toQuery converts a result of --query-expr to url.Values. null values are ignored.
+func toQuery(v interface{}) (url.Values, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("query must be an object: %v", v)
+	}
+	q := make(url.Values, len(m))
+	for k, v := range m {
+		vs, ok := v.([]interface{})
+		if !ok {
+			vs = []interface{}{v}
+		}
+		for _, v := range vs {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				q.Add(k, v)
+			case bool, int, float64:
+				q.Add(k, fmt.Sprint(v))
+			default:
+				return nil, fmt.Errorf("query value must be a scalar or an array of scalars: %v: %v", k, v)
+			}
+		}
+	}
+	return q, nil
+}
+
+// urlRequest is a result of --url, which is a URL string or an object of {url, method, body, headers, query}.
+// The fields of the object override --method, --body, --header-expr and --query-expr respectively.
+type urlRequest struct {
+	url     string
+	method  string
+	body    interface{}
+	hasBody bool
+	headers http.Header
+	query   url.Values
+}
+
+// methods are the choices of --method, also allowed as method of request objects.
+var methods = func() []string {
+	f, _ := reflect.TypeOf(Config{}).FieldByName("Method")
+	return choicesOf(f.Tag)
+}()
+
+func validMethod(method string) bool {
+	for _, m := range methods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+func toURLRequest(v interface{}) (urlRequest, error) {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return urlRequest{}, errors.New("url must not be empty")
+		}
+		return urlRequest{url: v}, nil
+	case map[string]interface{}:
+		var req urlRequest
+		for k, fv := range v {
+			var err error
+			switch k {
+			case "url", "method":
+				s, ok := fv.(string)
+				if !ok {
+					return req, fmt.Errorf("%v of request must be a string: %v", k, fv)
+				}
+				if k == "url" {
+					req.url = s
+				} else if !validMethod(s) {
+					return req, fmt.Errorf("method of request must be one of %v: %v", strings.Join(methods, ", "), s)
+				} else {
+					req.method = s
+				}
+			case "body":
+				req.body, req.hasBody = fv, fv != nil
+			case "headers":
+				req.headers, err = toHeader(fv)
+			case "query":
+				req.query, err = toQuery(fv)
+			default:
+				return req, fmt.Errorf("unknown key of request: %v", k)
+			}
+			if err != nil {
+				return req, err
+			}
+		}
+		if req.url == "" {
+			return req, fmt.Errorf("request must have url: %v", v)
+		}
+		return req, nil
+	case error:
+		return urlRequest{}, v
+	default:
+		return urlRequest{}, fmt.Errorf("not string or object: %v", v)
+	}
+}
+
+// mergeHeader returns h overridden by values of override, h itself if override is empty.
+func mergeHeader(h, override http.Header) http.Header {
+	if len(override) == 0 {
+		return h
+	}
+	merged := make(http.Header, len(h)+len(override))
+	for k, vs := range h {
+		merged[k] = vs
+	}
+	for k, vs := range override {
+		merged[k] = vs
+	}
+	return merged
+}
+
+// mergeQuery returns q overridden by values of override, q itself if override is empty.
+func mergeQuery(q, override url.Values) url.Values {
+	if len(override) == 0 {
+		return q
+	}
+	merged := make(url.Values, len(q)+len(override))
+	for k, vs := range q {
+		merged[k] = vs
+	}
+	for k, vs := range override {
+		merged[k] = vs
+	}
+	return merged
+}
+
+// fieldsWithPaths appends paths to the field mask unless their top-level fields are already selected.
+// Paths of jq filters are nil and ignored.
+func fieldsWithPaths(fields string, paths ...[]string) string {
+	selected := make(map[string]bool)
+	selectField := func(field string) {
+		if i := strings.IndexAny(field, "/("); i >= 0 {
+			field = field[:i]
+		}
+		selected[strings.TrimSpace(field)] = true
+	}
+	var depth, start int
+	for i, c := range fields {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				selectField(fields[start:i])
+				start = i + 1
+			}
+		}
+	}
+	selectField(fields[start:])
+
+	for _, path := range paths {
+		if len(path) == 0 || selected[path[0]] {
+			continue
+		}
+		fields += "," + strings.Join(path, "/")
+		selected[path[0]] = true
+	}
+	return fields
+}
+
+// nextLink returns the URL of rel="next" in Link headers (RFC 8288) resolved against base, or empty if there is none.
+func nextLink(h http.Header, base *url.URL) (string, error) {
+	for _, v := range h.Values("Link") {
+		// split by "<" instead of "," because URLs can contain ","
+		for rest := v; strings.TrimSpace(rest) != ""; {
+			start, end := strings.Index(rest, "<"), strings.Index(rest, ">")
+			if start < 0 || end < start {
+				return "", fmt.Errorf("invalid Link header: %v", v)
+			}
+			target, params := rest[start+1:end], rest[end+1:]
+			rest = ""
+			if i := strings.Index(params, "<"); i >= 0 {
+				params, rest = params[:i], params[i:]
+			}
+			for _, param := range strings.Split(params, ";") {
+				i := strings.Index(param, "=")
+				if i < 0 || !strings.EqualFold(strings.TrimSpace(param[:i]), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(param[i+1:], `", `)) {
+					if strings.EqualFold(rel, "next") {
+						return resolveURL(base, target)
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// resolveURL resolves ref, which may be relative, against base.
+func resolveURL(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
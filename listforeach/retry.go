@@ -0,0 +1,222 @@
+package listforeach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lestrrat-go/backoff/v2"
+)
+
+// retryBudgetKey is the context key of the retry budget of an input.
+type retryBudgetKey struct{}
+
+// withRetryBudget returns ctx allowing n retries in total to requests under it, e.g. all urls and pages of an input.
+func withRetryBudget(ctx context.Context, n int) context.Context {
+	left := int64(n)
+	return context.WithValue(ctx, retryBudgetKey{}, &left)
+}
+
+// takeRetry spends a retry of the budget of ctx, and reports false if it is already spent.
+// Without a budget, retries are only limited by --backoff-max-retries of each request.
+func takeRetry(ctx context.Context) bool {
+	left, ok := ctx.Value(retryBudgetKey{}).(*int64)
+	return !ok || atomic.AddInt64(left, -1) >= 0
+}
+
+// discardBody drains and closes resp.Body so the connection can be reused.
+func discardBody(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses Retry-After header in both delay-seconds and HTTP-date forms.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// rateLimitExceeded returns the reason if resp is 403 caused by rate limits rather than permissions,
+// which is found in error.errors[].reason of the standard Google error body.
+func rateLimitExceeded(resp *http.Response) (string, bool) {
+	if resp.StatusCode != http.StatusForbidden {
+		return "", false
+	}
+	for _, reason := range errorReasons(resp) {
+		switch reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// errorReasons returns error.errors[].reason of the body of resp, which is kept readable.
+func errorReasons(resp *http.Response) []string {
+	b, err := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil
+	}
+	var reasons []string
+	for _, e := range body.Error.Errors {
+		reasons = append(reasons, e.Reason)
+	}
+	return reasons
+}
+
+// retryReason returns the reason to retry resp, which is 429, 5xx in isRetryableStatus or 403 of rateLimitExceeded.
+func retryReason(resp *http.Response) (string, bool) {
+	if isRetryableStatus(resp.StatusCode) {
+		return resp.Status, true
+	}
+	if reason, ok := rateLimitExceeded(resp); ok {
+		return fmt.Sprintf("%v (%v)", resp.Status, reason), true
+	}
+	return "", false
+}
+
+const (
+	backoffExponential  = "exponential"
+	backoffFullJitter   = "full-jitter"
+	backoffDecorrelated = "decorrelated"
+	backoffConstant     = "constant"
+)
+
+// newBackoffPolicy returns the policy of retries by --backoff-strategy.
+func newBackoffPolicy(c Config) backoff.Policy {
+	switch c.BackoffStrategy {
+	case backoffFullJitter:
+		// AWS Architecture Blog "Exponential Backoff And Jitter"
+		return &intervalPolicy{maxRetries: c.MaxRetries, interval: func(n int, _ time.Duration) time.Duration {
+			d := c.BackoffMax
+			if n < 62 && c.BackoffMin<<n > 0 && c.BackoffMin<<n < d {
+				d = c.BackoffMin << n
+			}
+			return time.Duration(rand.Int63n(int64(d) + 1))
+		}}
+	case backoffDecorrelated:
+		return &intervalPolicy{maxRetries: c.MaxRetries, interval: func(_ int, prev time.Duration) time.Duration {
+			if prev < c.BackoffMin {
+				prev = c.BackoffMin
+			}
+			d := c.BackoffMin + time.Duration(rand.Int63n(int64(prev*3-c.BackoffMin)+1))
+			if d > c.BackoffMax {
+				d = c.BackoffMax
+			}
+			return d
+		}}
+	case backoffConstant:
+		return backoff.Constant(
+			backoff.WithInterval(c.BackoffMin),
+			backoff.WithJitterFactor(c.BackoffJitter),
+			backoff.WithMaxRetries(c.MaxRetries))
+	default:
+		return backoff.Exponential(
+			backoff.WithMinInterval(c.BackoffMin),
+			backoff.WithMaxInterval(c.BackoffMax),
+			backoff.WithJitterFactor(c.BackoffJitter),
+			backoff.WithMaxRetries(c.MaxRetries))
+	}
+}
+
+// intervalPolicy is a backoff.Policy of strategies which the backoff package doesn't have.
+// interval returns the interval before the retry n from 0, given the previous interval.
+type intervalPolicy struct {
+	maxRetries int
+	interval   func(n int, prev time.Duration) time.Duration
+}
+
+func (p *intervalPolicy) Start(ctx context.Context) backoff.Controller {
+	c := &intervalController{ctx: ctx, next: make(chan struct{}, 1)}
+	// the first attempt
+	c.next <- struct{}{}
+	go func() {
+		var d time.Duration
+		for n := 0; p.maxRetries <= 0 || n < p.maxRetries; n++ {
+			d = p.interval(n, d)
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case c.next <- struct{}{}:
+			}
+		}
+		// receivers get the last retry before the end
+		close(c.next)
+	}()
+	return c
+}
+
+type intervalController struct {
+	ctx  context.Context
+	next chan struct{}
+}
+
+func (c *intervalController) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+func (c *intervalController) Next() <-chan struct{} {
+	return c.next
+}
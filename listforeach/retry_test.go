@@ -0,0 +1,58 @@
+package listforeach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryExhausted(t *testing.T) {
+	var attempts int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable" {
+			atomic.AddInt64(&attempts, 1)
+			http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"name":"ok"}`)
+	}))
+	defer srv.Close()
+
+	config := DefaultConfig()
+	config.Url = []string{`"` + srv.URL + `/\(.)"`}
+	config.AccessToken = "test-token"
+	config.Execute = true
+	config.MaxRetries = 2
+	config.BackoffMin = time.Millisecond
+	config.BackoffMax = time.Millisecond
+
+	ctx := context.Background()
+	runner, err := New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = runner.Run(ctx, strings.NewReader(`"unavailable" "available"`), &out)
+	var failed *FailedError
+	if !errors.As(err, &failed) || failed.Failed != 1 || failed.Total != 2 {
+		t.Errorf("err = %v, want 1 of 2 urls failed", err)
+	}
+
+	if got, want := atomic.LoadInt64(&attempts), int64(config.MaxRetries+1); got != want {
+		t.Errorf("attempts = %v, want %v", got, want)
+	}
+	var record struct {
+		Input interface{} `json:"input"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil || record.Input != "available" {
+		t.Errorf("output = %q, want only the record of the available url", out.String())
+	}
+}
@@ -0,0 +1,113 @@
+package listforeach
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+)
+
+// maxOpenShards bounds files of --output-file-expr kept open at once, leaving file descriptors of connections
+// even under a small limit like ulimit -n 64.
+const maxOpenShards = 16
+
+// shardPool keeps at most max files of --output-file-expr open.
+// The least recently written file is closed to open another, and reopened for append on the next write.
+type shardPool struct {
+	max int
+	// sync commits data of a file before closing it for --flush-interval
+	sync bool
+	// lru has open shards, the most recently written first
+	lru *list.List
+}
+
+func newShardPool(max int, sync bool) *shardPool {
+	return &shardPool{max: max, sync: sync, lru: list.New()}
+}
+
+// shard is the writer of a file of --output-file-expr, used by encoders which outlive the open file.
+type shard struct {
+	pool    *shardPool
+	path    string
+	f       *os.File
+	elem    *list.Element
+	created bool
+}
+
+func (p *shardPool) shard(path string) *shard {
+	return &shard{pool: p, path: path}
+}
+
+func (s *shard) Write(b []byte) (int, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	return s.f.Write(b)
+}
+
+// open opens the file, or marks it as most recently used if already open.
+func (s *shard) open() error {
+	p := s.pool
+	if s.f != nil {
+		p.lru.MoveToFront(s.elem)
+		return nil
+	}
+	for p.lru.Len() >= p.max {
+		if err := p.lru.Back().Value.(*shard).close(); err != nil {
+			return err
+		}
+	}
+	var f *os.File
+	var err error
+	if !s.created {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+			return err
+		}
+		// truncate the file of a previous run only once
+		f, err = os.Create(s.path)
+	} else {
+		f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	}
+	if err != nil {
+		return err
+	}
+	s.f, s.created = f, true
+	s.elem = p.lru.PushFront(s)
+	return nil
+}
+
+func (s *shard) close() error {
+	if s.f == nil {
+		return nil
+	}
+	f := s.f
+	s.pool.lru.Remove(s.elem)
+	s.f, s.elem = nil, nil
+	if s.pool.sync {
+		if err := syncFile(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// syncAll syncs open files. Closed files are already synced if sync is set.
+func (p *shardPool) syncAll() error {
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		if err := syncFile(e.Value.(*shard).f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeAll closes open files.
+func (p *shardPool) closeAll() error {
+	var firstErr error
+	for p.lru.Len() > 0 {
+		if err := p.lru.Front().Value.(*shard).close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,109 @@
+package listforeach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ThenResult is the result of a follow-up request of ThenUrl for a collection item.
+type ThenResult struct {
+	// Item is the index of the item in the collection of all pages.
+	Item int
+	URL  string
+	// Response is the body decoded like responses of URLs, e.g. {rawBody, contentType} if it isn't JSON.
+	Response interface{}
+	// Status is the HTTP status code, or 0 if the request failed without a response or with a body rejected by StrictJSON.
+	Status int
+	Err    error
+}
+
+// thenURLs returns URLs generated by --then-url from each item, paired with the index of the item.
+// URLs may be relative to base, the URL of the collection, like paths of selfLink.
+func (r *Runner) thenURLs(base *url.URL, items []interface{}) ([]ThenResult, error) {
+	var results []ThenResult
+	for i, item := range items {
+		vs, err := runAll(r.thenUrlCode, item)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vs {
+			u, ok := v.(string)
+			if !ok || u == "" {
+				return nil, fmt.Errorf("--then-url must generate non-empty strings: %v", v)
+			}
+			u, err := resolveURL(base, u)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, ThenResult{Item: i, URL: u})
+		}
+	}
+	return results, nil
+}
+
+// then sends GET requests of --then-url for items of the collection of req, up to --parallelism at once with those of other urls.
+// Failures of follow-ups are kept in their results rather than failing the URL of the collection.
+func (r *Runner) then(ctx context.Context, req *http.Request, items []interface{}, index int) ([]ThenResult, error) {
+	results, err := r.thenURLs(req.URL, items)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for i := range results {
+		if err := r.thenSem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(res *ThenResult) {
+			defer wg.Done()
+			defer r.thenSem.Release(1)
+			res.Response, res.Status, res.Err = r.thenDo(ctx, req, res.URL, index)
+		}(&results[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// thenDo sends a follow-up GET request of u with headers of req, which requested the collection.
+func (r *Runner) thenDo(ctx context.Context, req *http.Request, u string, index int) (interface{}, int, error) {
+	thenReq, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	thenReq.Header = req.Header.Clone()
+	thenReq.Header.Del("Content-Type")
+	thenReq.Header.Del("If-None-Match")
+	r.overrideEndpoint(thenReq)
+	r.muStderr.Lock()
+	r.logger.url(severityDebug, urlEvent{Event: "then", Count: index, Method: thenReq.Method, URL: thenReq.URL.String()})
+	r.muStderr.Unlock()
+	resp, err := r.do(ctx, thenReq, index)
+	if err != nil {
+		r.logger.url(severityError, urlEvent{Event: "failed", Count: index, Method: thenReq.Method, URL: thenReq.URL.String(), Reason: err.Error()})
+		return nil, 0, err
+	}
+	body, err := func() ([]byte, error) {
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}()
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := r.decodeBody(resp, body, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid response of %v: %w", thenReq.URL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		errorResponsesTotal.WithLabelValues(statusLabel(resp.StatusCode)).Inc()
+		return v, resp.StatusCode, errors.New(resp.Status)
+	}
+	return v, resp.StatusCode, nil
+}
@@ -0,0 +1,77 @@
+package listforeach
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// xmlElement is an element in the middle of decodeXML.
+type xmlElement struct {
+	name     string
+	children map[string]interface{}
+	arrays   map[string]bool
+	text     strings.Builder
+}
+
+func (e *xmlElement) add(name string, v interface{}, array bool) {
+	if e.children == nil {
+		e.children = make(map[string]interface{})
+		e.arrays = make(map[string]bool)
+	}
+	prev, ok := e.children[name]
+	switch {
+	case e.arrays[name]:
+		e.children[name] = append(prev.([]interface{}), v)
+	case ok:
+		e.children[name] = []interface{}{prev, v}
+		e.arrays[name] = true
+	case array:
+		e.children[name] = []interface{}{v}
+		e.arrays[name] = true
+	default:
+		e.children[name] = v
+	}
+}
+
+func (e *xmlElement) value() interface{} {
+	if e.children == nil {
+		return e.text.String()
+	}
+	return e.children
+}
+
+// decodeXML converts an XML document like ListBucketResult of the Cloud Storage XML API to the JSON value of its root element.
+// An element with child elements is an object of them by the local names, and others are their text.
+// Elements repeated under the same parent, or named in arrayKeys, are arrays.
+// Attributes are ignored.
+func decodeXML(b []byte, arrayKeys map[string]bool) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	var stack []*xmlElement
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, errors.New("no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, &xmlElement{name: tok.Name.Local})
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(tok)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return e.value(), nil
+			}
+			stack[len(stack)-1].add(e.name, e.value(), arrayKeys[e.name])
+		}
+	}
+}
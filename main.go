@@ -1,56 +1,79 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"reflect"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/itchyny/gojq"
+	"github.com/apstndb/gcplistforeach/listforeach"
 	"github.com/jessevdk/go-flags"
-	"github.com/lestrrat-go/backoff/v2"
-	"go.uber.org/ratelimit"
-	"golang.org/x/oauth2/google"
-	"gopkg.in/yaml.v3"
-
-	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 )
 
-// Caution: nextPageToken should be included in filter
+const (
+	// exitCodeTimeout follows timeout(1).
+	exitCodeTimeout = 124
+	// exitCodePartialFailure and exitCodeTotalFailure are used if some or all urls failed.
+	exitCodePartialFailure = 2
+	exitCodeTotalFailure   = 3
+	// exitCodeInterrupted follows shells for SIGINT, also used for SIGTERM.
+	exitCodeInterrupted = 130
+)
 
 func main() {
-	if err := _main(); err != nil {
-		panic(err)
+	opts, err := parseOpts()
+	if err != nil {
+		os.Exit(1)
+	}
+	// cancel the run on the first signal to finish writing in-flight outputs, and exit immediately on the second
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if err := _main(ctx, opts); err != nil {
+		if ctx.Err() != nil {
+			logError(opts.LogFormat, errors.New("interrupted"))
+			os.Exit(exitCodeInterrupted)
+		}
+		logError(opts.LogFormat, err)
+		var failedErr *listforeach.FailedError
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			os.Exit(exitCodeTimeout)
+		case errors.As(err, &failedErr) && failedErr.Failed == failedErr.Total:
+			os.Exit(exitCodeTotalFailure)
+		case errors.As(err, &failedErr):
+			os.Exit(exitCodePartialFailure)
+		}
+		os.Exit(1)
 	}
 }
 
 type opts struct {
-	BillingProject string `long:"billing-project" env:"GCLOUD_BILLING_QUOTA_PROJECT"`
-	Parallelism    int64  `long:"parallelism" default:"1"`
-	LogHttp        bool   `long:"log-http"`
-	RateLimit      int    `long:"rate-limit-per-minute"`
-	Url            string `long:"url" description:"URL generator written by jq filter" unquote:"false"`
-	Execute        bool   `long:"execute" description:"Execute without dry-run"`
-	Verbose        bool   `long:"verbose"`
-	CollectionName string `long:"collection" description:"Collection name in favor of AIP-132 for paging (exclusive with --auto-collection"`
-	AutoCollection bool   `long:"auto-collection" description:"Infer collection name from URL for paging (exclusive with --collection)"`
-	YamlInput      bool   `long:"yaml-input"`
-	RawInput       bool   `long:"raw-input"`
-	IncludeError   bool   `long:"include-error"`
-	YamlOutput     bool   `long:"yaml-output"`
+	listforeach.Config
+	InputFile  string `long:"input-file" description:"File to read inputs from instead of stdin"`
+	OutputFile string `long:"output-file" description:"File to write output instead of stdout"`
+
+	Otel         bool   `long:"otel" description:"Export OpenTelemetry spans of inputs and requests by OTLP/HTTP"`
+	OtelEndpoint string `long:"otel-endpoint" description:"host:port of the OTLP/HTTP endpoint (default: $OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318)"`
+	OtelInsecure bool   `long:"otel-insecure" description:"Export spans without TLS"`
+
+	MetricsAddr string `long:"metrics-addr" description:"Address to serve Prometheus metrics on /metrics during the run, e.g. :9090"`
 }
 
 func isErrHelp(err error) bool {
@@ -59,6 +82,7 @@ func isErrHelp(err error) bool {
 	}
 	return false
 }
+
 func parseOpts() (o opts, err error) {
 	flagParser := flags.NewParser(&o, flags.Default)
 	defer func() {
@@ -75,255 +99,106 @@ func parseOpts() (o opts, err error) {
 	if err != nil {
 		return o, err
 	}
-	if o.YamlInput && o.RawInput {
-		return o, errors.New("--yaml-input and --raw-input are exclusive")
+	if o.OutputFile != "" && o.OutputFileExpr != "" {
+		return o, errors.New("--output-file and --output-file-expr are exclusive")
 	}
-	if o.AutoCollection && o.CollectionName != "" {
-		return o, errors.New("--auto-collection and --collection are exclusive")
+	if !o.Otel && (o.OtelEndpoint != "" || o.OtelInsecure) {
+		return o, errors.New("--otel-endpoint and --otel-insecure require --otel")
 	}
-	return o, nil
-}
-
-// adapter for bufio.Scanner
-type lineDecoder struct {
-	input *bufio.Scanner
-}
-
-type output struct {
-	Input    interface{} `json:"input"`
-	Response interface{} `json:"response"`
+	return o, o.Validate()
 }
 
-func (d *lineDecoder) Decode(i interface{}) error {
-	if !d.input.Scan() {
-		if d.input.Err() == nil {
-			return io.EOF
-		}
-		return d.input.Err()
+// serveMetrics serves /metrics on addr in background.
+// It listens synchronously to report errors of the address before the run.
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
-	reflect.Indirect(reflect.ValueOf(i)).Set(reflect.ValueOf(d.input.Text()))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go http.Serve(l, mux)
 	return nil
 }
 
-func _main() error {
-	opts, err := parseOpts()
-	if err != nil {
-		os.Exit(1)
-	}
-
-	if opts.AutoCollection && opts.CollectionName != "" {
-		return errors.New("--auto-collection and --collection are exclusive")
+// setupTracing installs the global tracer provider exporting spans to the OTLP/HTTP endpoint.
+// The returned function flushes pending spans.
+func setupTracing(ctx context.Context, opts opts) (func(context.Context) error, error) {
+	var exporterOpts []otlptracehttp.Option
+	if opts.OtelEndpoint != "" {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithEndpoint(opts.OtelEndpoint))
 	}
-
-	var rl ratelimit.Limiter
-	if opts.RateLimit != 0 {
-		rl = ratelimit.New(opts.RateLimit, ratelimit.Per(time.Minute))
-	} else {
-		rl = ratelimit.NewUnlimited()
+	if opts.OtelInsecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
 	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("gcplistforeach"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
 
-	backoffPolicy := backoff.Exponential(
-		backoff.WithMinInterval(1*time.Second),
-		backoff.WithMaxInterval(time.Minute),
-		backoff.WithJitterFactor(0.1))
+// logError logs err in the format of --log-format.
+func logError(format string, err error) {
+	if format != "json" {
+		log.Print(err)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Time     time.Time `json:"time"`
+		Severity string    `json:"severity"`
+		Message  string    `json:"message"`
+	}{time.Now(), "ERROR", err.Error()})
+	log.Writer().Write(append(b, '\n'))
+}
 
-	query, err := gojq.Parse(fmt.Sprintf(`%s`, opts.Url))
-	if err != nil {
-		return err
+func _main(ctx context.Context, opts opts) error {
+	if opts.Otel {
+		shutdown, err := setupTracing(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// export spans even if interrupted
+			if err := shutdown(context.Background()); err != nil {
+				logError(opts.LogFormat, fmt.Errorf("failed to export spans: %w", err))
+			}
+		}()
 	}
-	code, err := gojq.Compile(query)
-	if err != nil {
-		return err
+	if opts.MetricsAddr != "" {
+		if err := serveMetrics(opts.MetricsAddr); err != nil {
+			return err
+		}
 	}
-
-	ctx := context.Background()
-	client, err := google.DefaultClient(ctx)
+	runner, err := listforeach.New(ctx, opts.Config)
 	if err != nil {
 		return err
 	}
 
-	var enc interface {
-		Encode(interface{}) error
-	}
-	if opts.YamlOutput {
-		enc = yaml.NewEncoder(os.Stdout)
-	} else {
-		enc = json.NewEncoder(os.Stdout)
-	}
-
-	sem := semaphore.NewWeighted(opts.Parallelism)
-	var muStderr sync.Mutex
-	var muStdout sync.Mutex
-
-	var dec interface {
-		Decode(interface{}) error
-	}
-
-	if opts.RawInput {
-		dec = &lineDecoder{bufio.NewScanner(os.Stdin)}
-	} else if opts.YamlInput {
-		dec = yaml.NewDecoder(os.Stdin)
-	} else {
-		dec = json.NewDecoder(os.Stdin)
-	}
-
-	var count int
-	eg, ctx := errgroup.WithContext(ctx)
-	for {
-		var input interface{}
-		if err := dec.Decode(&input); err == io.EOF {
-			break
-		} else if err != nil {
+	var in io.Reader = os.Stdin
+	if opts.InputFile != "" && opts.InputFile != "-" {
+		f, err := os.Open(opts.InputFile)
+		if err != nil {
 			return err
 		}
+		defer f.Close()
+		in = f
+	}
 
-		run := code.Run(input)
-		for {
-			i, ok := run.Next()
-			if !ok {
-				break
-			}
-			baseUrl, ok := i.(string)
-			if !ok {
-				return fmt.Errorf("not string: %v", i)
-			}
-
-			nowCount := count
-			count++
-
-			var collectionName string
-			if opts.CollectionName != "" {
-				collectionName = opts.CollectionName
-			} else if opts.AutoCollection {
-				u, err := url.Parse(baseUrl)
-				if err != nil {
-					return err
-				}
-
-				pathElems := strings.Split(u.Path, "/")
-				collectionName = pathElems[len(pathElems)-1]
-			}
-
-			// Acquire semaphore before eg.Go to stabilize output order when parallelism=1
-			if err := sem.Acquire(ctx, 1); err != nil {
-				return err
-			}
-			eg.Go(func() error {
-				defer sem.Release(1)
-				var nextPageToken string
-				var collection []interface{}
-				var result output
-				for {
-					req, err := http.NewRequest(http.MethodGet, baseUrl, nil)
-					if err != nil {
-						return err
-					}
-					q := req.URL.Query()
-					if nextPageToken != "" {
-						q.Add("pageToken", nextPageToken)
-					}
-					req.URL.RawQuery = q.Encode()
-					if opts.BillingProject != "" {
-						req.Header.Add("x-goog-user-project", opts.BillingProject)
-					}
-					if !opts.Execute || opts.Verbose {
-						muStderr.Lock()
-						log.Printf("do url[%v]: %v %v\n", nowCount, req.Method, req.URL.String())
-						muStderr.Unlock()
-					}
-					if !opts.Execute {
-						return nil
-					}
-
-					backoffCtl := backoffPolicy.Start(ctx)
-					resp, err := func() (*http.Response, error) {
-						for backoff.Continue(backoffCtl) {
-							resp, err := func() (*http.Response, error) {
-								var buf bytes.Buffer
-								if opts.LogHttp {
-									defer func() {
-										muStderr.Lock()
-										defer muStderr.Unlock()
-										io.Copy(os.Stderr, &buf)
-									}()
-								}
-								b, _ := httputil.DumpRequest(req, true)
-								buf.Write(b)
-
-								rl.Take()
-								resp, err := client.Do(req)
-								if err != nil {
-									return nil, err
-								}
-								b, _ = httputil.DumpResponse(resp, true)
-								buf.Write(b)
-								return resp, nil
-							}()
-
-							if err != nil {
-								return resp, err
-							} else if resp.StatusCode == http.StatusOK {
-								return resp, nil
-							} else if resp.StatusCode == http.StatusTooManyRequests {
-								log.Printf("retry url[%v]: %v %v, reason: %v\n", nowCount, resp.Request.Method, resp.Request.URL.String(), resp.Status)
-								continue
-							} else if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-								log.Printf("error url[%v]: %v %v, reason: %v\n", nowCount, resp.Request.Method, resp.Request.URL.String(), resp.Status)
-								return resp, nil
-							}
-						}
-						return nil, errors.New("backoff finally failed")
-					}()
-
-					body, err := io.ReadAll(resp.Body)
-					if err != nil {
-						return err
-					}
-
-					var i map[string]interface{}
-					err = json.Unmarshal(body, &i)
-					if err != nil {
-						return err
-					}
-
-					if !opts.IncludeError && resp.StatusCode != http.StatusOK {
-						return nil
-					}
-
-					if collectionName == "" || resp.StatusCode != http.StatusOK {
-						result = output{
-							Input:    input,
-							Response: i,
-						}
-						break
-					}
-
-					if c, ok := i[collectionName].([]interface{}); ok {
-						collection = append(collection, c...)
-					}
-					if npt, ok := i["nextPageToken"].(string); ok {
-						nextPageToken = npt
-						continue
-					}
-					response := make(map[string]interface{})
-					// leave response empty if collection is nil
-					if collection != nil {
-						response[collectionName] = collection
-					}
-					result = output{
-						Input:    input,
-						Response: response,
-					}
-					break
-				}
-
-				return func() error {
-					muStdout.Lock()
-					defer muStdout.Unlock()
-					return enc.Encode(result)
-				}()
-			})
+	var out io.Writer = os.Stdout
+	if opts.OutputFile != "" && opts.OutputFile != "-" {
+		f, err := os.Create(opts.OutputFile)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		out = f
 	}
-	return eg.Wait()
+
+	return runner.Run(ctx, in, out)
 }